@@ -0,0 +1,60 @@
+// Package fmp4 writes CMAF-style fragmented MP4 (initialization segment +
+// media segments cut at random-access-point boundaries) for the VVC and
+// MPEG-H 3D audio tracks this module already detects via H266Record and
+// MpeghAudioRecord. It mirrors the fragmented writer pattern used by
+// bluenviron/mediacommon's pmp4, adapted to this module's PES/PID model.
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// box wraps payload in an ISOBMFF box: a 4-byte big-endian size followed by
+// the 4-byte type and the payload itself. Nested boxes are built by
+// concatenating child box() output into the parent's payload.
+func box(boxType string, payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(8+len(payload)))
+	copy(buf[4:8], boxType)
+	copy(buf[8:], payload)
+	return buf
+}
+
+func concat(parts ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+func u8(v uint8) []byte { return []byte{v} }
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+func u24(v uint32) []byte {
+	b := make([]byte, 3)
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+	return b
+}
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// fullBox prepends the version/flags word full boxes (fullbox) carry ahead
+// of their own fields.
+func fullBox(version uint8, flags uint32) []byte {
+	return concat(u8(version), u24(flags))
+}
@@ -0,0 +1,139 @@
+package fmp4
+
+// ftyp announces a CMAF-compatible fragmented MP4.
+func ftypBox() []byte {
+	return box("ftyp", concat(
+		[]byte("iso5"), u32(0),
+		[]byte("iso5"), []byte("cmfc"), []byte("mp42"),
+	))
+}
+
+func identityMatrix() []byte {
+	return concat(
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+	)
+}
+
+func tkhdBox(trackID uint32, width, height uint16) []byte {
+	return box("tkhd", concat(
+		fullBox(0, 0x000007), // enabled | in_movie | in_preview
+		u32(0), u32(0),       // creation/modification time
+		u32(trackID),
+		u32(0),          // reserved
+		u32(0),          // duration, unknown
+		make([]byte, 8), // reserved
+		u16(0), u16(0),  // layer, alternate_group
+		u16(0), u16(0), // volume, reserved
+		identityMatrix(),
+		u32(uint32(width)<<16),
+		u32(uint32(height)<<16),
+	))
+}
+
+func mdhdBox(timescale uint32) []byte {
+	return box("mdhd", concat(
+		fullBox(0, 0),
+		u32(0), u32(0), // creation/modification time
+		u32(timescale),
+		u32(0),      // duration, unknown
+		u16(0x55c4), // language "und"
+		u16(0),
+	))
+}
+
+func hdlrBox(handlerType, name string) []byte {
+	return box("hdlr", concat(
+		fullBox(0, 0),
+		u32(0),
+		[]byte(handlerType),
+		make([]byte, 12), // reserved
+		[]byte(name), []byte{0},
+	))
+}
+
+func vmhdBox() []byte {
+	return box("vmhd", concat(fullBox(0, 1), make([]byte, 8)))
+}
+
+func smhdBox() []byte {
+	return box("smhd", concat(fullBox(0, 0), u16(0), u16(0)))
+}
+
+func dinfBox() []byte {
+	urlBox := box("url ", fullBox(0, 1))
+	dref := box("dref", concat(fullBox(0, 0), u32(1), urlBox))
+	return box("dinf", dref)
+}
+
+// emptyTableBoxes are the sample tables a fragmented track's stbl still must
+// carry even though every sample lives in moof/mdat instead.
+func emptyTableBoxes() []byte {
+	stts := box("stts", concat(fullBox(0, 0), u32(0)))
+	stsc := box("stsc", concat(fullBox(0, 0), u32(0)))
+	stsz := box("stsz", concat(fullBox(0, 0), u32(0), u32(0)))
+	stco := box("stco", concat(fullBox(0, 0), u32(0)))
+	return concat(stts, stsc, stsz, stco)
+}
+
+func stblBox(sampleEntry []byte) []byte {
+	stsd := box("stsd", concat(fullBox(0, 0), u32(1), sampleEntry))
+	return box("stbl", concat(stsd, emptyTableBoxes()))
+}
+
+func minfBox(t *track) []byte {
+	var mediaHeader []byte
+	if t.kind == "vvc1" {
+		mediaHeader = vmhdBox()
+	} else {
+		mediaHeader = smhdBox()
+	}
+	return box("minf", concat(mediaHeader, dinfBox(), stblBox(t.sampleEntry)))
+}
+
+func mdiaBox(t *track) []byte {
+	handlerType, name := "vide", "VVC Video Handler"
+	if t.kind == "mhm1" {
+		handlerType, name = "soun", "MPEG-H Audio Handler"
+	}
+	return box("mdia", concat(mdhdBox(t.timescale), hdlrBox(handlerType, name), minfBox(t)))
+}
+
+func trakBox(t *track) []byte {
+	return box("trak", concat(tkhdBox(uint32(t.id), t.width, t.height), mdiaBox(t)))
+}
+
+func trexBox(trackID uint32) []byte {
+	return box("trex", concat(
+		fullBox(0, 0),
+		u32(trackID),
+		u32(1), // default_sample_description_index
+		u32(0), u32(0), u32(0),
+	))
+}
+
+func moovBox(tracks []*track, movieTimescale uint32) []byte {
+	var traks, trexs []byte
+	for _, t := range tracks {
+		traks = append(traks, trakBox(t)...)
+		trexs = append(trexs, trexBox(uint32(t.id))...)
+	}
+	mvex := box("mvex", trexs)
+	return box("moov", concat(mvhdBox(movieTimescale, uint32(len(tracks)+1)), traks, mvex))
+}
+
+func mvhdBox(timescale, nextTrackID uint32) []byte {
+	return box("mvhd", concat(
+		fullBox(0, 0),
+		u32(0), u32(0),
+		u32(timescale),
+		u32(0),
+		u32(0x00010000),
+		u16(0x0100), u16(0),
+		make([]byte, 8),
+		identityMatrix(),
+		make([]byte, 24),
+		u32(nextTrackID),
+	))
+}
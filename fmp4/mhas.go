@@ -0,0 +1,38 @@
+package fmp4
+
+// MHAConfig mirrors the mhaC box payload (ISO/IEC 23008-3's
+// MHADecoderConfigurationRecord), built from the PACTYP_MPEGH3DACFG payload
+// the MHAS parser in the internal package already extracts.
+type MHAConfig struct {
+	ConfigurationVersion           uint8
+	Mpegh3daProfileLevelIndication uint8
+	ReferenceChannelLayout         uint8
+	Mpegh3daConfig                 []byte // raw MHASPacketPayload() of the MPEGH3DACFG packet
+}
+
+// Marshal encodes the record into the mhaC box payload.
+func (c *MHAConfig) Marshal() []byte {
+	return concat(
+		u8(c.ConfigurationVersion),
+		u8(c.Mpegh3daProfileLevelIndication),
+		u8(c.ReferenceChannelLayout),
+		u16(uint16(len(c.Mpegh3daConfig))),
+		c.Mpegh3daConfig,
+	)
+}
+
+// mhm1SampleEntry builds the mhm1 sample entry box (an AudioSampleEntry
+// carrying an mhaC box).
+func mhm1SampleEntry(channelCount uint16, sampleRate uint32, mhaC *MHAConfig) []byte {
+	payload := concat(
+		make([]byte, 6), // reserved
+		u16(1),          // data_reference_index
+		make([]byte, 8), // reserved
+		u16(channelCount),
+		u16(16),         // samplesize
+		make([]byte, 4), // pre_defined / reserved
+		u32(sampleRate<<16),
+		box("mhaC", mhaC.Marshal()),
+	)
+	return box("mhm1", payload)
+}
@@ -0,0 +1,248 @@
+package fmp4
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type sample struct {
+	data []byte
+	pts  int64
+	dts  int64
+}
+
+type track struct {
+	id          int
+	pid         int
+	name        string
+	kind        string // "vvc1" or "mhm1"
+	timescale   uint32
+	width       uint16
+	height      uint16
+	sampleEntry []byte
+	samples     []sample
+	baseTime    uint64
+}
+
+// Muxer writes a CMAF-style fragmented MP4: one initialization segment
+// covering every track in pid2track, then a media segment per RAP-bounded
+// fragment, both under root.
+type Muxer struct {
+	root        string
+	pid2track   map[int]string
+	tracks      map[int]*track
+	initWritten bool
+	seq         uint32
+}
+
+// NewMuxer returns a Muxer that will demux the PIDs named in pid2track into
+// root/init.mp4 plus root/seg-NNNNN.m4s fragments.
+func NewMuxer(root string, pid2track map[int]string) *Muxer {
+	tracks := make(map[int]*track, len(pid2track))
+	id := 1
+	for pid, name := range pid2track {
+		tracks[pid] = &track{id: id, pid: pid, name: name, timescale: 90000}
+		id++
+	}
+	return &Muxer{root: root, pid2track: pid2track, tracks: tracks}
+}
+
+// SetVVCConfig supplies the vvc1 sample entry for pid once its parameter
+// sets (and therefore its VvcDecoderConfigurationRecord) are known.
+func (m *Muxer) SetVVCConfig(pid int, width, height uint16, cfg *VvcDecoderConfigurationRecord) {
+	t, ok := m.tracks[pid]
+	if !ok {
+		return
+	}
+	t.kind = "vvc1"
+	t.width, t.height = width, height
+	t.sampleEntry = vvc1SampleEntry(width, height, cfg)
+}
+
+// SetMHAConfig supplies the mhm1 sample entry for pid once its
+// MPEGH3DACFG payload has been captured.
+func (m *Muxer) SetMHAConfig(pid int, channelCount uint16, sampleRate uint32, cfg *MHAConfig) {
+	t, ok := m.tracks[pid]
+	if !ok {
+		return
+	}
+	t.kind = "mhm1"
+	t.sampleEntry = mhm1SampleEntry(channelCount, sampleRate, cfg)
+}
+
+// AddSample buffers one access unit for pid. data must already be in the
+// track's sample format: length-prefixed NAL units for a vvc1 track, the
+// raw MHAS access unit bytes for an mhm1 track.
+func (m *Muxer) AddSample(pid int, data []byte, pts, dts int64) {
+	t, ok := m.tracks[pid]
+	if !ok {
+		return
+	}
+	t.samples = append(t.samples, sample{data: data, pts: pts, dts: dts})
+}
+
+// Flush is called from each record's Process loop once per access unit,
+// before that access unit is added, rap reporting whether it is a random
+// access point (a VVC IDR/CRA or recovered GDR picture, or an MHAS access
+// unit carrying a config or sync packet). Every track's buffered samples are
+// written out as one fragment whenever any track reports a RAP, so the
+// reporting track's RAP opens the next fragment; a fragment cut by an audio
+// RAP need not start on a video IDR/CRA.
+func (m *Muxer) Flush(rap bool) error {
+	if !rap {
+		return nil
+	}
+	if !m.initWritten {
+		// Every registered track needs its sample entry before init.mp4 is
+		// written, or a track whose config (e.g. VVC's SPS/PPS) hasn't
+		// arrived yet when another track's RAP fires first would be
+		// permanently dropped from the init segment.
+		if !m.allTracksReady() {
+			return nil
+		}
+		if err := m.writeInitSegment(); err != nil {
+			return err
+		}
+		m.initWritten = true
+	}
+	if m.anyPendingSamples() {
+		return m.writeFragment()
+	}
+	return nil
+}
+
+// allTracksReady reports whether every registered track has a sample entry,
+// i.e. SetVVCConfig/SetMHAConfig has been called for it.
+func (m *Muxer) allTracksReady() bool {
+	for _, t := range m.tracks {
+		if t.sampleEntry == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Muxer) anyPendingSamples() bool {
+	for _, t := range m.tracks {
+		if len(t.samples) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Muxer) orderedTracks() []*track {
+	tracks := make([]*track, 0, len(m.tracks))
+	for _, t := range m.tracks {
+		tracks = append(tracks, t)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].id < tracks[j].id })
+	return tracks
+}
+
+func (m *Muxer) writeInitSegment() error {
+	var tracksWithEntry []*track
+	for _, t := range m.orderedTracks() {
+		if t.sampleEntry != nil {
+			tracksWithEntry = append(tracksWithEntry, t)
+		}
+	}
+	data := concat(ftypBox(), moovBox(tracksWithEntry, 90000))
+	return os.WriteFile(filepath.Join(m.root, "init.mp4"), data, 0644)
+}
+
+func (m *Muxer) writeFragment() error {
+	m.seq++
+	var moofPayload []byte
+	var mdatPayload []byte
+
+	type pendingTraf struct {
+		trunOffset  int // position of the trun's data_offset field within moof
+		sampleBytes int // this track's share of mdatPayload, in write order
+	}
+	var pending []pendingTraf
+
+	moofPayload = append(moofPayload, box("mfhd", concat(fullBox(0, 0), u32(m.seq)))...)
+
+	for _, t := range m.orderedTracks() {
+		if len(t.samples) == 0 {
+			continue
+		}
+		tfhd := box("tfhd", concat(fullBox(0, 0x020000), u32(uint32(t.id)))) // default-base-is-moof
+		tfdt := box("tfdt", concat(fullBox(1, 0), u64(t.baseTime)))
+
+		var trunEntries []byte
+		sampleBytes := 0
+		for i, s := range t.samples {
+			dts := s.dts
+			if dts == 0 {
+				dts = s.pts
+			}
+			duration := uint32(t.timescale / 25) // best-effort default; refined once neighbouring PTS are known
+			if i+1 < len(t.samples) {
+				next := t.samples[i+1].dts
+				if next == 0 {
+					next = t.samples[i+1].pts
+				}
+				if d := next - dts; d > 0 {
+					duration = uint32(d)
+				}
+			}
+			ctsOffset := int32(s.pts - dts)
+			trunEntries = append(trunEntries, concat(
+				u32(duration),
+				u32(uint32(len(s.data))),
+				u32(0), // sample_flags
+				u32(uint32(ctsOffset)),
+			)...)
+			mdatPayload = append(mdatPayload, s.data...)
+			sampleBytes += len(s.data)
+		}
+		if len(t.samples) > 0 {
+			last := t.samples[len(t.samples)-1]
+			dts := last.dts
+			if dts == 0 {
+				dts = last.pts
+			}
+			t.baseTime = uint64(dts)
+		}
+
+		trunFlags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800) // data-offset, duration, size, flags, cts
+		trunHeader := concat(fullBox(0, trunFlags), u32(uint32(len(t.samples))))
+		// data_offset is a signed 4-byte field right after the sample count,
+		// at this position relative to the start of moofPayload (the moof
+		// box header is prepended below, so add 8 once everything is known).
+		dataOffsetPos := len(moofPayload) + 8 /*traf box header*/ + len(tfhd) + len(tfdt) + 8 /*trun box header*/ + len(trunHeader)
+		trun := box("trun", concat(trunHeader, u32(0), trunEntries))
+		traf := box("traf", concat(tfhd, tfdt, trun))
+		pending = append(pending, pendingTraf{trunOffset: dataOffsetPos + 8, sampleBytes: sampleBytes})
+		moofPayload = append(moofPayload, traf...)
+
+		t.samples = nil
+	}
+
+	moof := box("moof", moofPayload)
+
+	// Fix up each trun's data_offset now that moof's total size (and thus
+	// the mdat payload's start) is known; each track's samples sit back to
+	// back in mdat in the same order its traf was written.
+	mdatBytesSoFar := 0
+	for _, p := range pending {
+		offset := int32(len(moof) + 8 /*mdat box header*/ + mdatBytesSoFar)
+		putI32(moof, p.trunOffset, offset)
+		mdatBytesSoFar += p.sampleBytes
+	}
+
+	mdat := box("mdat", mdatPayload)
+	fname := filepath.Join(m.root, fmt.Sprintf("seg-%05d.m4s", m.seq))
+	return os.WriteFile(fname, concat(moof, mdat), 0644)
+}
+
+func putI32(buf []byte, offset int, v int32) {
+	buf[offset] = byte(v >> 24)
+	buf[offset+1] = byte(v >> 16)
+	buf[offset+2] = byte(v >> 8)
+	buf[offset+3] = byte(v)
+}
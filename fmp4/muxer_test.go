@@ -0,0 +1,31 @@
+package fmp4
+
+import "testing"
+
+func TestMuxerAllTracksReady(t *testing.T) {
+	m := NewMuxer(t.TempDir(), map[int]string{100: "video", 200: "audio"})
+	if m.allTracksReady() {
+		t.Fatal("allTracksReady() = true before any SetVVCConfig/SetMHAConfig call")
+	}
+	m.SetVVCConfig(100, 1920, 1080, &VvcDecoderConfigurationRecord{LengthSizeMinusOne: 3})
+	if m.allTracksReady() {
+		t.Fatal("allTracksReady() = true with the audio track still missing its sample entry")
+	}
+	m.SetMHAConfig(200, 2, 48000, &MHAConfig{})
+	if !m.allTracksReady() {
+		t.Fatal("allTracksReady() = false once every track has a sample entry")
+	}
+}
+
+func TestMuxerOrderedTracksSortedById(t *testing.T) {
+	m := NewMuxer(t.TempDir(), map[int]string{300: "c", 100: "a", 200: "b"})
+	tracks := m.orderedTracks()
+	if len(tracks) != 3 {
+		t.Fatalf("orderedTracks() returned %d tracks, want 3", len(tracks))
+	}
+	for i := 1; i < len(tracks); i++ {
+		if tracks[i-1].id >= tracks[i].id {
+			t.Fatalf("orderedTracks() not sorted by id: %+v", tracks)
+		}
+	}
+}
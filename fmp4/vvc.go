@@ -0,0 +1,80 @@
+package fmp4
+
+// VVC NAL unit types that matter for the decoder configuration record
+// (ISO/IEC 23090-3), duplicated here rather than imported from the internal
+// package since fmp4 only needs the numeric values, not the name table.
+const (
+	vvcNalDCI = 13
+	vvcNalVPS = 14
+	vvcNalSPS = 15
+	vvcNalPPS = 16
+)
+
+// VvcDecoderConfigurationRecord mirrors the vvcC box payload (ISO/IEC
+// 14496-15's VvcDecoderConfigurationRecord), built from the VPS/DCI/SPS/PPS
+// NAL units H266Record collects while walking the elementary stream.
+type VvcDecoderConfigurationRecord struct {
+	LengthSizeMinusOne uint8 // size of the NALU length prefix this muxer writes, minus one
+
+	DCI [][]byte
+	VPS [][]byte
+	SPS [][]byte
+	PPS [][]byte
+}
+
+// Marshal encodes the record into the vvcC box payload.
+func (r *VvcDecoderConfigurationRecord) Marshal() []byte {
+	var arrays []byte
+	nArrays := 0
+	for _, group := range []struct {
+		nalType uint8
+		nalus   [][]byte
+	}{
+		{vvcNalDCI, r.DCI},
+		{vvcNalVPS, r.VPS},
+		{vvcNalSPS, r.SPS},
+		{vvcNalPPS, r.PPS},
+	} {
+		if len(group.nalus) == 0 {
+			continue
+		}
+		nArrays++
+		// array_completeness(1) reserved(1) NAL_unit_type(6)
+		arrays = append(arrays, group.nalType&0x3F)
+		arrays = append(arrays, u16(uint16(len(group.nalus)))...)
+		for _, nalu := range group.nalus {
+			arrays = append(arrays, u16(uint16(len(nalu)))...)
+			arrays = append(arrays, nalu...)
+		}
+	}
+
+	return concat(
+		// reserved(5)='11111' LengthSizeMinusOne(2) ptl_present_flag(1). We
+		// don't carry a VvcPTLRecord, so ptl_present_flag is always 0 and no
+		// profile/tier/level bytes follow, per ISO/IEC 14496-15.
+		u8(0xF8|(r.LengthSizeMinusOne&0x03)<<1),
+		u8(uint8(nArrays)),
+		arrays,
+	)
+}
+
+// vvc1SampleEntry builds the vvc1 sample entry box (a VisualSampleEntry
+// carrying a vvcC box) for width x height luma samples.
+func vvc1SampleEntry(width, height uint16, vvcC *VvcDecoderConfigurationRecord) []byte {
+	payload := concat(
+		make([]byte, 6),  // reserved
+		u16(1),           // data_reference_index
+		make([]byte, 16), // pre_defined / reserved
+		u16(width),
+		u16(height),
+		u32(0x00480000),  // horizresolution 72dpi
+		u32(0x00480000),  // vertresolution 72dpi
+		u32(0),           // reserved
+		u16(1),           // frame_count
+		make([]byte, 32), // compressorname
+		u16(0x0018),      // depth
+		u16(0xFFFF),      // pre_defined
+		box("vvcC", vvcC.Marshal()),
+	)
+	return box("vvc1", payload)
+}
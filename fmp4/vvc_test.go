@@ -0,0 +1,34 @@
+package fmp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVvcDecoderConfigurationRecordMarshal(t *testing.T) {
+	cfg := &VvcDecoderConfigurationRecord{
+		LengthSizeMinusOne: 3,
+		SPS:                [][]byte{{0xAA, 0xBB}},
+		PPS:                [][]byte{{0xCC}},
+	}
+	got := cfg.Marshal()
+
+	want := concat(
+		u8(0xF8|(3&0x03)<<1), // reserved(5)='11111' LengthSizeMinusOne(2)=3 ptl_present_flag(1)=0
+		u8(2),                // num_of_arrays: SPS, PPS
+		u8(vvcNalSPS&0x3F), u16(1), u16(2), []byte{0xAA, 0xBB},
+		u8(vvcNalPPS&0x3F), u16(1), u16(1), []byte{0xCC},
+	)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Marshal() = % x, want % x", got, want)
+	}
+}
+
+func TestVvcDecoderConfigurationRecordMarshalEmpty(t *testing.T) {
+	cfg := &VvcDecoderConfigurationRecord{LengthSizeMinusOne: 3}
+	got := cfg.Marshal()
+	want := []byte{0xF8 | 3<<1, 0}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Marshal() = % x, want % x", got, want)
+	}
+}
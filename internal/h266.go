@@ -2,12 +2,16 @@ package mpts
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/AlvinLi-harmonicinc/mpts/fmp4"
 )
 
 // VVC/H.266 NAL unit types (ISO/IEC 23090-3)
@@ -57,39 +61,391 @@ func GetVvcNalUnitType(b int) string {
 }
 
 func ParseVvcNalUnits(data []byte) []string {
-	var nals []string
-	var pos int
+	detailed := ParseVvcNalUnitsDetailed(data)
+	nals := make([]string, 0, len(detailed))
+	for _, nal := range detailed {
+		nals = append(nals, nal.Type)
+	}
+	return nals
+}
+
+// VvcNalUnit is a single Annex-B NAL unit found by ParseVvcNalUnitsDetailed,
+// along with the RBSP bytes following its 2-byte NAL header (still carrying
+// emulation prevention bytes).
+type VvcNalUnit struct {
+	Type    string
+	Payload []byte
+	// Raw is the complete NAL unit (2-byte header plus Payload, start code
+	// excluded) exactly as it appeared in the bitstream, for callers like
+	// VvcDecoderConfigurationRecord that store whole NAL units rather than
+	// parse them.
+	Raw []byte
+}
+
+// ParseVvcNalUnitsDetailed is ParseVvcNalUnits plus each NAL unit's payload,
+// for callers that need to decode parameter sets and picture headers rather
+// than just classify NAL types.
+func ParseVvcNalUnitsDetailed(data []byte) []VvcNalUnit {
+	var starts []int
 	var startcode = []byte{0, 0, 1}
 	var startlen = len(startcode)
+	var pos int
 	for pos+5 < len(data) {
 		if bytes.Compare(startcode, data[pos:pos+startlen]) == 0 {
 			pos += startlen
-			// VVC uses 2-byte NAL header
 			if pos+1 < len(data) {
-				nalHeaderByte1 := int(data[pos+1])
-				nal := GetVvcNalUnitType(nalHeaderByte1)
-				nals = append(nals, nal)
+				starts = append(starts, pos)
 			}
 		}
 		pos += 1
 	}
+
+	nals := make([]VvcNalUnit, 0, len(starts))
+	for i, s := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1] - startlen
+			if end > s && data[end-1] == 0 {
+				end-- // trailing zero_byte of a 4-byte 00 00 00 01 start code
+			}
+		}
+		if end <= s+1 {
+			continue
+		}
+		nal := VvcNalUnit{Type: GetVvcNalUnitType(int(data[s+1])), Raw: data[s:end]}
+		if end > s+2 {
+			nal.Payload = data[s+2 : end]
+		}
+		nals = append(nals, nal)
+	}
 	return nals
 }
 
+// removeEmulationPrevention strips the 0x03 emulation prevention byte from a
+// NAL unit's RBSP (ITU-T H.266 Annex-B), turning it into the true RBSP a bit
+// reader can decode parameter sets from.
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeroRun := 0
+	for _, b := range data {
+		if zeroRun >= 2 && b == 0x03 {
+			zeroRun = 0
+			continue
+		}
+		if b == 0x00 {
+			zeroRun++
+		} else {
+			zeroRun = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
 type NalInfo struct {
 	Pos  int64
 	Pts  int64
 	Nals []string
 }
 
+// VvcSPS is the subset of a VVC sequence_parameter_set_rbsp() (ISO/IEC
+// 23090-3) this package decodes: the resolution and profile/level fields
+// needed for reporting. Fields signaled after sps_pic_height_max_in_luma_samples
+// (conformance window, subpicture layout, bit depth, ...) aren't parsed yet.
+type VvcSPS struct {
+	SpsSeqParameterSetId         uint8
+	SpsChromaFormatIdc           uint8
+	SpsPicWidthMaxInLumaSamples  uint64
+	SpsPicHeightMaxInLumaSamples uint64
+	GeneralProfileIdc            uint8
+	GeneralLevelIdc              uint8
+}
+
+// VvcPPS is the subset of a VVC pps_parameter_set_rbsp() this package
+// decodes: just enough to identify which SPS a PPS activates.
+type VvcPPS struct {
+	PpsPicParameterSetId uint8
+	PpsSeqParameterSetId uint8
+}
+
+// VvcPH is the subset of a VVC picture_header_structure() needed to tell a
+// genuine GDR recovery point (ph_recovery_poc_cnt == 0) from a GDR picture
+// still inside its recovery period.
+type VvcPH struct {
+	GdrOrIrapPicFlag bool
+	GdrPicFlag       bool
+	RecoveryPocCnt   uint64
+}
+
+// ResolutionChange records a mid-stream change of sps_pic_width/height_max,
+// detected when an SPS activates with different dimensions than the last one
+// seen.
+type ResolutionChange struct {
+	Pos    int64
+	Pts    int64
+	Width  uint64
+	Height uint64
+}
+
 type H266Record struct {
 	BaseRecord
-	curpkt *PesPkt
-	Pkts   []*PesPkt
+	curpkt   *PesPkt
+	Pkts     []*PesPkt
 	NalInfos []NalInfo
 	// Workaround PES parsing error
 	WorkaroundPESFlag bool
 	WorkaroundPES     []byte
+
+	// Muxer, when set, receives each access unit as a vvc1 fmp4 sample and
+	// is asked to cut a fragment whenever a RAP is detected.
+	Muxer *fmp4.Muxer
+
+	// SPS/PPS hold every parameter set seen so far, keyed by id. ActivePPS
+	// is the most recently parsed PPS.
+	SPS       map[uint8]*VvcSPS
+	PPS       map[uint8]*VvcPPS
+	ActivePPS *VvcPPS
+
+	// spsRaw/ppsRaw mirror SPS/PPS but hold the complete NAL unit (header
+	// plus still-emulation-prevented RBSP) for feeding into
+	// VvcDecoderConfigurationRecord. vps/dci hold the most recently seen
+	// VPS/DCI NAL unit the same way; VVC signals at most one DCI per CVS and
+	// this package doesn't yet track multiple concurrent VPS ids.
+	spsRaw        map[uint8][]byte
+	ppsRaw        map[uint8][]byte
+	vps, dci      []byte
+	vvcConfigSent bool
+
+	lastWidth, lastHeight uint64
+	ResolutionChanges     []ResolutionChange
+}
+
+// byteAlign discards bits until r is positioned at a byte boundary, mirroring
+// the "while (!byte_aligned())" constructs VVC's parameter set syntax uses.
+func byteAlign(r *Reader) {
+	if r.Off != 0 {
+		r.ReadBit64(8 - r.Off)
+	}
+}
+
+// readUE reads an Exp-Golomb coded unsigned integer (ue(v)), as used
+// throughout VVC's parameter set and picture header syntax.
+func readUE(r *Reader) uint64 {
+	leadingZeroBits := 0
+	for r.ReadBit64(1) == 0 {
+		leadingZeroBits++
+		if leadingZeroBits > 32 {
+			return 0
+		}
+	}
+	if leadingZeroBits == 0 {
+		return 0
+	}
+	return (uint64(1)<<leadingZeroBits - 1) + r.ReadBit64(leadingZeroBits)
+}
+
+// vvcProfileTierLevel is the profile/tier/level fields profile_tier_level()
+// carries ahead of the general_constraint_info() block.
+type vvcProfileTierLevel struct {
+	GeneralProfileIdc uint8
+	GeneralTierFlag   bool
+	GeneralLevelIdc   uint8
+}
+
+// parseVvcProfileTierLevel decodes profile_tier_level(1, maxSublayersMinus1)
+// (ISO/IEC 23090-3 7.3.3.1), called with profileTierPresentFlag always true
+// since that's the only case sequence_parameter_set_rbsp() uses it in.
+//
+// general_constraint_info()'s gci_present_flag==1 case carries a long list
+// of per-profile constraint flags this parser doesn't walk; when it's set,
+// decoding stops here rather than risk silently misreading the rest of the
+// SPS against a bitstream it has lost alignment with.
+func parseVvcProfileTierLevel(r *Reader, maxSublayersMinus1 uint8) (vvcProfileTierLevel, bool) {
+	var p vvcProfileTierLevel
+	p.GeneralProfileIdc = uint8(r.ReadBit64(7))
+	p.GeneralTierFlag = r.ReadBit64(1) != 0
+	p.GeneralLevelIdc = uint8(r.ReadBit64(8))
+	_ = r.ReadBit64(1) // ptl_frame_only_constraint_flag
+	_ = r.ReadBit64(1) // ptl_multilayer_enabled_flag
+
+	if r.ReadBit64(1) != 0 { // gci_present_flag
+		return p, false
+	}
+	byteAlign(r) // general_constraint_info()'s trailing alignment bits
+
+	sublayerLevelPresent := make([]bool, maxSublayersMinus1)
+	for i := int(maxSublayersMinus1) - 1; i >= 0; i-- {
+		sublayerLevelPresent[i] = r.ReadBit64(1) != 0
+	}
+	byteAlign(r)
+	for i := int(maxSublayersMinus1) - 1; i >= 0; i-- {
+		if sublayerLevelPresent[i] {
+			_ = r.ReadBit64(8) // sublayer_level_idc[i]
+		}
+	}
+	numSubProfiles := r.ReadBit64(8)
+	for j := uint64(0); j < numSubProfiles; j++ {
+		_ = r.ReadBit64(32) // general_sub_profile_idc[j]
+	}
+	return p, true
+}
+
+// parseVvcSPS decodes the leading fields of a sequence_parameter_set_rbsp()
+// (ISO/IEC 23090-3 7.3.2.3): ids, chroma format, profile/level, and the
+// picture's maximum resolution. rbsp must already have emulation prevention
+// bytes removed.
+func parseVvcSPS(rbsp []byte) *VvcSPS {
+	r := &Reader{Data: rbsp}
+	sps := &VvcSPS{}
+	sps.SpsSeqParameterSetId = uint8(r.ReadBit64(4))
+	_ = r.ReadBit64(4) // sps_video_parameter_set_id
+	maxSublayersMinus1 := uint8(r.ReadBit64(3))
+	sps.SpsChromaFormatIdc = uint8(r.ReadBit64(2))
+	_ = r.ReadBit64(2) // sps_log2_ctu_size_minus5
+	ptlPresent := r.ReadBit64(1) != 0
+	if ptlPresent {
+		if ptl, ok := parseVvcProfileTierLevel(r, maxSublayersMinus1); ok {
+			sps.GeneralProfileIdc = ptl.GeneralProfileIdc
+			sps.GeneralLevelIdc = ptl.GeneralLevelIdc
+		} else {
+			return sps
+		}
+	}
+	_ = r.ReadBit64(1)       // sps_gdr_enabled_flag
+	if r.ReadBit64(1) != 0 { // sps_ref_pic_resampling_enabled_flag
+		_ = r.ReadBit64(1) // sps_res_change_in_clvs_allowed_flag
+	}
+	sps.SpsPicWidthMaxInLumaSamples = readUE(r)
+	sps.SpsPicHeightMaxInLumaSamples = readUE(r)
+	return sps
+}
+
+// ParseVvcSPS decodes a sps_nut NAL unit's payload (RBSP, still carrying
+// emulation prevention bytes, as returned by ParseVvcNalUnitsDetailed) into a
+// VvcSPS, for callers like Probe that need resolution/profile/level without
+// keeping a full H266Record.
+func ParseVvcSPS(payload []byte) *VvcSPS {
+	return parseVvcSPS(removeEmulationPrevention(payload))
+}
+
+// parseVvcPPS decodes the leading ids of a pps_parameter_set_rbsp() (ISO/IEC
+// 23090-3 7.3.2.4). The tile/subpicture layout flags follow
+// pps_pic_width/height_in_luma_samples, which are u(v) fields sized from the
+// active SPS's CTU size this package doesn't thread through yet, so parsing
+// stops after the ids rather than guess their width.
+func parseVvcPPS(rbsp []byte) *VvcPPS {
+	r := &Reader{Data: rbsp}
+	pps := &VvcPPS{}
+	pps.PpsPicParameterSetId = uint8(r.ReadBit64(6))
+	pps.PpsSeqParameterSetId = uint8(r.ReadBit64(4))
+	return pps
+}
+
+// parseVvcPH decodes the leading fields of a picture_header_structure()
+// (ISO/IEC 23090-3 7.3.2.8) needed to tell a GDR recovery point from a GDR
+// picture still in its recovery period.
+//
+// ph_pic_order_cnt_lsb is u(v), sized from
+// sps_log2_max_pic_order_cnt_lsb_minus4, which this package's SPS parser
+// doesn't reach yet; 8 bits (log2_max_pic_order_cnt_lsb_minus4 == 4) is
+// assumed, matching HM's default configuration, until that SPS field is
+// wired through.
+func parseVvcPH(rbsp []byte) *VvcPH {
+	r := &Reader{Data: rbsp}
+	ph := &VvcPH{}
+	ph.GdrOrIrapPicFlag = r.ReadBit64(1) != 0
+	_ = r.ReadBit64(1) // ph_non_ref_pic_flag
+	if ph.GdrOrIrapPicFlag {
+		ph.GdrPicFlag = r.ReadBit64(1) != 0
+	}
+	if r.ReadBit64(1) != 0 { // ph_inter_slice_allowed_flag
+		_ = r.ReadBit64(1) // ph_intra_slice_allowed_flag
+	}
+	_ = readUE(r)      // ph_pic_parameter_set_id
+	_ = r.ReadBit64(8) // ph_pic_order_cnt_lsb (assumed width, see above)
+	if ph.GdrPicFlag {
+		ph.RecoveryPocCnt = readUE(r)
+	}
+	return ph
+}
+
+// ParseVvcPH decodes a ph_nut NAL unit's payload (RBSP, still carrying
+// emulation prevention bytes, as returned by ParseVvcNalUnitsDetailed) into
+// a VvcPH, for callers like Probe that need GDR recovery detection without
+// keeping a full H266Record.
+func ParseVvcPH(payload []byte) *VvcPH {
+	return parseVvcPH(removeEmulationPrevention(payload))
+}
+
+// checkResolutionChange records a ResolutionChange when sps activates with
+// different dimensions than the last SPS this record saw.
+func (s *H266Record) checkResolutionChange(sps *VvcSPS, pos, pts int64) {
+	if s.lastWidth != 0 && (sps.SpsPicWidthMaxInLumaSamples != s.lastWidth || sps.SpsPicHeightMaxInLumaSamples != s.lastHeight) {
+		s.ResolutionChanges = append(s.ResolutionChanges, ResolutionChange{
+			Pos:    pos,
+			Pts:    pts,
+			Width:  sps.SpsPicWidthMaxInLumaSamples,
+			Height: sps.SpsPicHeightMaxInLumaSamples,
+		})
+	}
+	s.lastWidth, s.lastHeight = sps.SpsPicWidthMaxInLumaSamples, sps.SpsPicHeightMaxInLumaSamples
+}
+
+// maybeSendVVCConfig hands the Muxer a VvcDecoderConfigurationRecord the
+// first time an SPS is parsed, so the fmp4 init segment can be written
+// (resolution comes from sps; any VPS/DCI/PPS seen so far are included too)
+// before the first fragment is flushed.
+func (s *H266Record) maybeSendVVCConfig(sps *VvcSPS) {
+	if s.Muxer == nil || s.vvcConfigSent {
+		return
+	}
+	cfg := &fmp4.VvcDecoderConfigurationRecord{
+		LengthSizeMinusOne: 3, // matches the 4-byte lengths annexBToLengthPrefixed writes
+	}
+	if s.vps != nil {
+		cfg.VPS = [][]byte{s.vps}
+	}
+	if s.dci != nil {
+		cfg.DCI = [][]byte{s.dci}
+	}
+	if raw, ok := s.spsRaw[sps.SpsSeqParameterSetId]; ok {
+		cfg.SPS = [][]byte{raw}
+	}
+	if s.ActivePPS != nil {
+		if raw, ok := s.ppsRaw[s.ActivePPS.PpsPicParameterSetId]; ok {
+			cfg.PPS = [][]byte{raw}
+		}
+	}
+	s.Muxer.SetVVCConfig(s.Pid, uint16(sps.SpsPicWidthMaxInLumaSamples), uint16(sps.SpsPicHeightMaxInLumaSamples), cfg)
+	s.vvcConfigSent = true
+}
+
+// annexBToLengthPrefixed rewrites Annex-B start-code-delimited NAL units
+// into the 4-byte length-prefixed form an fmp4 vvc1 sample needs.
+func annexBToLengthPrefixed(data []byte) []byte {
+	var out []byte
+	var startcode = []byte{0, 0, 1}
+	pos := 0
+	for pos+len(startcode) <= len(data) {
+		if !bytes.Equal(startcode, data[pos:pos+len(startcode)]) {
+			pos++
+			continue
+		}
+		nalStart := pos + len(startcode)
+		nalEnd := len(data)
+		for next := nalStart + 1; next+len(startcode) <= len(data); next++ {
+			if bytes.Equal(startcode, data[next:next+len(startcode)]) {
+				nalEnd = next
+				break
+			}
+		}
+		lenBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBuf, uint32(nalEnd-nalStart))
+		out = append(out, lenBuf...)
+		out = append(out, data[nalStart:nalEnd]...)
+		pos = nalEnd
+	}
+	return out
 }
 
 const minVvcPesHeaderLen = 19
@@ -98,23 +454,79 @@ func (s *H266Record) Process(pkt *TsPkt) {
 	s.LogAdaptFieldPrivData(pkt)
 	if pkt.PUSI == 1 {
 		if s.curpkt != nil {
-			nals := ParseVvcNalUnits(s.curpkt.Data)
-			for _, nal := range nals {
-				// VVC RAP (Random Access Point) NAL units: IDR and CRA
-				if nal == "idr_w_radl" || nal == "idr_n_lp" || nal == "cra_nut" {
-					info := IFrameInfo{}
-					info.Pos = s.curpkt.Pos
-					info.Pts = s.curpkt.Pts
-					info.Key = true
-					s.LogIFrame(info)
+			detailed := ParseVvcNalUnitsDetailed(s.curpkt.Data)
+			nals := make([]string, 0, len(detailed))
+			isRap := false
+			var lastPH *VvcPH
+			var activeSPS *VvcSPS
+			for _, nal := range detailed {
+				nals = append(nals, nal.Type)
+				switch nal.Type {
+				case "idr_w_radl", "idr_n_lp", "cra_nut":
+					isRap = true
+				case "gdr_nut":
+					// A GDR picture is only a genuine random-access point
+					// once its recovery period has fully elapsed.
+					if lastPH != nil && lastPH.GdrPicFlag && lastPH.RecoveryPocCnt == 0 {
+						isRap = true
+					}
+				case "ph_nut":
+					lastPH = parseVvcPH(removeEmulationPrevention(nal.Payload))
+				case "vps_nut":
+					s.vps = append([]byte{}, nal.Raw...)
+				case "dci_nut":
+					s.dci = append([]byte{}, nal.Raw...)
+				case "sps_nut":
+					sps := parseVvcSPS(removeEmulationPrevention(nal.Payload))
+					if s.SPS == nil {
+						s.SPS = make(map[uint8]*VvcSPS)
+					}
+					s.SPS[sps.SpsSeqParameterSetId] = sps
+					if s.spsRaw == nil {
+						s.spsRaw = make(map[uint8][]byte)
+					}
+					s.spsRaw[sps.SpsSeqParameterSetId] = append([]byte{}, nal.Raw...)
+					s.checkResolutionChange(sps, s.curpkt.Pos, s.curpkt.Pts)
+					activeSPS = sps
+				case "pps_nut":
+					pps := parseVvcPPS(removeEmulationPrevention(nal.Payload))
+					if s.PPS == nil {
+						s.PPS = make(map[uint8]*VvcPPS)
+					}
+					s.PPS[pps.PpsPicParameterSetId] = pps
+					s.ActivePPS = pps
+					if s.ppsRaw == nil {
+						s.ppsRaw = make(map[uint8][]byte)
+					}
+					s.ppsRaw[pps.PpsPicParameterSetId] = append([]byte{}, nal.Raw...)
 				}
 			}
+			// Deferred until the whole access unit has been scanned so that
+			// a PPS arriving after its SPS in the same AU (the common case)
+			// is already in s.ActivePPS by the time the config is built.
+			if activeSPS != nil {
+				s.maybeSendVVCConfig(activeSPS)
+			}
+			if isRap {
+				info := IFrameInfo{}
+				info.Pos = s.curpkt.Pos
+				info.Pts = s.curpkt.Pts
+				info.Key = true
+				s.LogIFrame(info)
+			}
 			s.NalInfos = append(s.NalInfos, NalInfo{
 				Pos:  s.curpkt.Pos,
 				Pts:  s.curpkt.Pts,
 				Nals: nals,
 			})
 			s.Pkts = append(s.Pkts, s.curpkt)
+
+			if s.Muxer != nil {
+				if err := s.Muxer.Flush(isRap); err != nil {
+					log.Println("fmp4 mux error:", err)
+				}
+				s.Muxer.AddSample(s.Pid, annexBToLengthPrefixed(s.curpkt.Data), s.curpkt.Pts, s.curpkt.Dts)
+			}
 		}
 		s.curpkt = &PesPkt{}
 		s.curpkt.Pos = pkt.Pos
@@ -216,4 +628,58 @@ func (s *H266Record) Report(root string) {
 		fmt.Fprintln(w, strings.Join(cols, ", "))
 	}
 	w.Close()
+
+	if len(s.SPS) > 0 {
+		fname = filepath.Join(root, pid+"-sps"+".csv")
+		w, err = os.Create(fname)
+		if err != nil {
+			panic(err)
+		}
+		header = "SPS id, Chroma format, Width, Height, Profile, Level"
+		fmt.Fprintln(w, header)
+		for _, id := range sortedUint8Keys(s.SPS) {
+			sps := s.SPS[id]
+			cols := []string{
+				strconv.Itoa(int(sps.SpsSeqParameterSetId)),
+				strconv.Itoa(int(sps.SpsChromaFormatIdc)),
+				strconv.FormatUint(sps.SpsPicWidthMaxInLumaSamples, 10),
+				strconv.FormatUint(sps.SpsPicHeightMaxInLumaSamples, 10),
+				strconv.Itoa(int(sps.GeneralProfileIdc)),
+				strconv.Itoa(int(sps.GeneralLevelIdc)),
+			}
+			fmt.Fprintln(w, strings.Join(cols, ", "))
+		}
+		w.Close()
+	}
+
+	if len(s.ResolutionChanges) > 0 {
+		fname = filepath.Join(root, pid+"-resolution-changes"+".csv")
+		w, err = os.Create(fname)
+		if err != nil {
+			panic(err)
+		}
+		header = "Pos, PTS, Width, Height"
+		fmt.Fprintln(w, header)
+		for _, rc := range s.ResolutionChanges {
+			cols := []string{
+				strconv.FormatInt(rc.Pos, 10),
+				strconv.FormatInt(rc.Pts, 10),
+				strconv.FormatUint(rc.Width, 10),
+				strconv.FormatUint(rc.Height, 10),
+			}
+			fmt.Fprintln(w, strings.Join(cols, ", "))
+		}
+		w.Close()
+	}
+}
+
+// sortedUint8Keys returns a map's keys in ascending order, for deterministic
+// report output.
+func sortedUint8Keys(m map[uint8]*VvcSPS) []uint8 {
+	keys := make([]uint8, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
 }
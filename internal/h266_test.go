@@ -0,0 +1,85 @@
+package mpts
+
+import "testing"
+
+func TestReadUE(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want uint64
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x40}, 1},
+		{[]byte{0x60}, 2},
+		{[]byte{0x20}, 3},
+		{[]byte{0x38}, 6},
+	}
+	for _, c := range cases {
+		got := readUE(&Reader{Data: c.data})
+		if got != c.want {
+			t.Errorf("readUE(% x) = %d, want %d", c.data, got, c.want)
+		}
+	}
+}
+
+func TestParseVvcPPS(t *testing.T) {
+	// pps_pic_parameter_set_id=5 (6 bits), pps_seq_parameter_set_id=3 (4 bits).
+	pps := parseVvcPPS([]byte{0x14, 0xC0})
+	if pps.PpsPicParameterSetId != 5 {
+		t.Errorf("PpsPicParameterSetId = %d, want 5", pps.PpsPicParameterSetId)
+	}
+	if pps.PpsSeqParameterSetId != 3 {
+		t.Errorf("PpsSeqParameterSetId = %d, want 3", pps.PpsSeqParameterSetId)
+	}
+}
+
+func TestParseVvcSPSWithoutPTL(t *testing.T) {
+	// sps_seq_parameter_set_id=7, sps_video_parameter_set_id=0,
+	// sps_max_sublayers_minus1=0, sps_chroma_format_idc=1,
+	// sps_log2_ctu_size_minus5=0, sps_ptl_present_flag=0,
+	// sps_gdr_enabled_flag=0, sps_ref_pic_resampling_enabled_flag=0,
+	// sps_pic_width_max_in_luma_samples=ue(6), sps_pic_height_max_in_luma_samples=ue(3).
+	sps := parseVvcSPS([]byte{0x70, 0x08, 0x0e, 0x40})
+	if sps.SpsSeqParameterSetId != 7 {
+		t.Errorf("SpsSeqParameterSetId = %d, want 7", sps.SpsSeqParameterSetId)
+	}
+	if sps.SpsChromaFormatIdc != 1 {
+		t.Errorf("SpsChromaFormatIdc = %d, want 1", sps.SpsChromaFormatIdc)
+	}
+	if sps.SpsPicWidthMaxInLumaSamples != 6 {
+		t.Errorf("SpsPicWidthMaxInLumaSamples = %d, want 6", sps.SpsPicWidthMaxInLumaSamples)
+	}
+	if sps.SpsPicHeightMaxInLumaSamples != 3 {
+		t.Errorf("SpsPicHeightMaxInLumaSamples = %d, want 3", sps.SpsPicHeightMaxInLumaSamples)
+	}
+}
+
+func TestParseVvcPHGdrRecovery(t *testing.T) {
+	cases := []struct {
+		name           string
+		data           []byte
+		wantGdrPicFlag bool
+		wantRecovery   uint64
+	}{
+		// gdr_or_irap_pic_flag=1, non_ref_pic_flag=0, gdr_pic_flag=1,
+		// inter_slice_allowed_flag=0, ph_pic_parameter_set_id=ue(0),
+		// ph_pic_order_cnt_lsb=5 (8 bits), ph_recovery_poc_cnt=ue(0): the
+		// recovery period has fully elapsed, so this is a genuine RAP.
+		{"recovered", []byte{0xa8, 0x2c}, true, 0},
+		// Same, but ph_recovery_poc_cnt=ue(2): still inside the recovery
+		// period, not yet a RAP.
+		{"not yet recovered", []byte{0xa8, 0x2b}, true, 2},
+		// gdr_or_irap_pic_flag=1, gdr_pic_flag=0: an IDR/CRA picture, not GDR.
+		{"non-GDR IRAP", []byte{0x88, 0x28}, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ph := parseVvcPH(c.data)
+			if ph.GdrPicFlag != c.wantGdrPicFlag {
+				t.Errorf("GdrPicFlag = %v, want %v", ph.GdrPicFlag, c.wantGdrPicFlag)
+			}
+			if ph.GdrPicFlag && ph.RecoveryPocCnt != c.wantRecovery {
+				t.Errorf("RecoveryPocCnt = %d, want %d", ph.RecoveryPocCnt, c.wantRecovery)
+			}
+		})
+	}
+}
@@ -2,39 +2,42 @@ package mpts
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/AlvinLi-harmonicinc/mpts/fmp4"
 )
 
 // MPEG-H 3D Audio packet types (ISO/IEC 23008-3)
 var MpeghAudioPacketType []string = []string{
-	"PACTYP_FILLDATA",      // 0
-	"PACTYP_MPEGH3DACFG",   // 1 - Config
-	"PACTYP_MPEGH3DAFRAME", // 2 - Audio Frame
-	"PACTYP_AUDIOSCENEINFO", // 3
-	"PACTYP_SYNC",          // 6
-	"PACTYP_SYNCGAP",       // 7
-	"PACTYP_MARKER",        // 8
-	"PACTYP_CRC16",         // 9
-	"PACTYP_CRC32",         // 10
-	"PACTYP_DESCRIPTOR",    // 11
+	"PACTYP_FILLDATA",        // 0
+	"PACTYP_MPEGH3DACFG",     // 1 - Config
+	"PACTYP_MPEGH3DAFRAME",   // 2 - Audio Frame
+	"PACTYP_AUDIOSCENEINFO",  // 3
+	"PACTYP_SYNC",            // 6
+	"PACTYP_SYNCGAP",         // 7
+	"PACTYP_MARKER",          // 8
+	"PACTYP_CRC16",           // 9
+	"PACTYP_CRC32",           // 10
+	"PACTYP_DESCRIPTOR",      // 11
 	"PACTYP_USERINTERACTION", // 12
-	"PACTYP_LOUDNESS_DRC",  // 13
-	"PACTYP_BUFFERINFO",    // 14
-	"PACTYP_GLOBAL_CRC16",  // 15
-	"PACTYP_GLOBAL_CRC32",  // 16
+	"PACTYP_LOUDNESS_DRC",    // 13
+	"PACTYP_BUFFERINFO",      // 14
+	"PACTYP_GLOBAL_CRC16",    // 15
+	"PACTYP_GLOBAL_CRC32",    // 16
 	"PACTYP_AUDIOTRUNCATION", // 17
-	"PACTYP_GENDATA",       // 18
+	"PACTYP_GENDATA",         // 18
 }
 
 func GetMpeghAudioPacketType(packetType int) string {
 	// Handle label values (upper 3 bits determine packet type for some values)
 	actualType := packetType
-	
+
 	typeMap := map[int]string{
 		0:  MpeghAudioPacketType[0],
 		1:  MpeghAudioPacketType[1],
@@ -66,19 +69,203 @@ type MhasPacketInfo struct {
 	PacketTypes []string
 }
 
+// Mpegh3daConfig is the subset of mpegh3daConfig() (ISO/IEC 23008-3) needed
+// to describe the stream's core audio coding parameters and reference
+// rendering layout; the remaining usacConfig()/extension-element fields
+// aren't needed for the summary this package reports.
+type Mpegh3daConfig struct {
+	Mpegh3daProfileLevelIndication uint8
+	UsacSamplingFrequencyIndex     uint8
+	UsacSamplingFrequency          uint32 // only set when the index escapes to 0x1F
+	CoreSbrFrameLengthIndex        uint8
+	ReceiverDelayCompensation      bool
+	ReferenceLayout                SpeakerConfig3d
+	NumSignals3d                   uint64
+}
+
+// SpeakerConfig3d is speakerConfig3d(): a CICP layout index, or a speaker
+// count when the layout escapes to flexible geometry (index 63).
+type SpeakerConfig3d struct {
+	CICPSpeakerLayoutIdx uint8
+	NumSpeakers          uint64 // only meaningful when CICPSpeakerLayoutIdx == 63
+}
+
+// LoudnessInfoSet is the first measurement of the first loudnessInfo()
+// entry in a loudnessInfoSet() (PACTYP_LOUDNESS_DRC) payload.
+type LoudnessInfoSet struct {
+	MethodValue       uint8
+	MeasurementSystem uint8
+	Reliability       uint8
+	BsSamplePeakLevel uint16
+}
+
+// AudioTruncationInfo is audioTruncationInfo() (PACTYP_AUDIOTRUNCATION).
+type AudioTruncationInfo struct {
+	Active    bool
+	FromBegin bool
+	Samples   uint32
+}
+
+// MhasConfigEvent records one decoded MPEGH3DACFG/LOUDNESS_DRC/AUDIOTRUNCATION
+// packet, keyed by the PES access unit it was found in.
+type MhasConfigEvent struct {
+	Pos  int64
+	Pts  int64
+	Kind string
+
+	Config     *Mpegh3daConfig
+	Loudness   *LoudnessInfoSet
+	Truncation *AudioTruncationInfo
+}
+
+// parseSpeakerConfig3d parses speakerConfig3d().
+func parseSpeakerConfig3d(r *Reader) SpeakerConfig3d {
+	sc := SpeakerConfig3d{CICPSpeakerLayoutIdx: uint8(r.ReadBit64(6))}
+	if sc.CICPSpeakerLayoutIdx == 63 {
+		sc.NumSpeakers = parseEscapedValue(r, 5, 8, 16) + 1
+		// Flexible speaker geometry (azimuth/elevation per speaker) follows
+		// but isn't needed for the summary this package reports.
+	}
+	return sc
+}
+
+// parseMpegh3daConfig parses the leading fields of mpegh3daConfig().
+func parseMpegh3daConfig(r *Reader) *Mpegh3daConfig {
+	cfg := &Mpegh3daConfig{}
+	cfg.Mpegh3daProfileLevelIndication = uint8(r.ReadBit64(8))
+	cfg.UsacSamplingFrequencyIndex = uint8(r.ReadBit64(5))
+	if cfg.UsacSamplingFrequencyIndex == 0x1F {
+		cfg.UsacSamplingFrequency = uint32(r.ReadBit64(24))
+	}
+	cfg.CoreSbrFrameLengthIndex = uint8(r.ReadBit64(3))
+	cfg.ReceiverDelayCompensation = r.ReadBit64(1) != 0
+	cfg.ReferenceLayout = parseSpeakerConfig3d(r)
+	cfg.NumSignals3d = parseEscapedValue(r, 5, 8, 16) + 1
+	// Remaining usacConfig()/mpegh3daExtElementConfig() fields (element
+	// layout, SAOC/object metadata, extension elements) aren't needed for
+	// the summary this package reports and are left unparsed.
+	return cfg
+}
+
+// ParseMpegh3daConfig decodes a PACTYP_MPEGH3DACFG packet's raw payload
+// into a Mpegh3daConfig, for callers like Probe that need the channel/
+// sample-rate summary without keeping a full MpeghAudioRecord.
+func ParseMpegh3daConfig(payload []byte) *Mpegh3daConfig {
+	return parseMpegh3daConfig(&Reader{Data: payload})
+}
+
+// usacSamplingFrequencyTable maps usacSamplingFrequencyIndex (ISO/IEC
+// 23003-3 Table 79) to Hz for every non-escape index; index 0x1F (escape)
+// carries the frequency explicitly in UsacSamplingFrequency instead.
+var usacSamplingFrequencyTable = map[uint8]uint32{
+	0x00: 96000, 0x01: 88200, 0x02: 64000, 0x03: 48000,
+	0x04: 44100, 0x05: 32000, 0x06: 24000, 0x07: 22050,
+	0x08: 16000, 0x09: 12000, 0x0A: 11025, 0x0B: 8000,
+	0x0C: 7350, 0x10: 57600, 0x11: 51200, 0x12: 40000,
+	0x13: 38400, 0x14: 34100, 0x15: 28800, 0x16: 25600,
+	0x17: 20000, 0x18: 19200,
+}
+
+// SamplingFrequency resolves UsacSamplingFrequencyIndex to Hz, following the
+// escape value's explicit UsacSamplingFrequency when present.
+func (c *Mpegh3daConfig) SamplingFrequency() uint32 {
+	if c.UsacSamplingFrequencyIndex == 0x1F {
+		return c.UsacSamplingFrequency
+	}
+	return usacSamplingFrequencyTable[c.UsacSamplingFrequencyIndex]
+}
+
+// parseLoudnessInfoEntry parses one loudnessInfo() entry (its drcSetId/
+// downmixId followed by the sample-peak/true-peak/measurement fields this
+// package cares about).
+func parseLoudnessInfoEntry(r *Reader) *LoudnessInfoSet {
+	_ = r.ReadBit64(6) // drcSetId
+	_ = r.ReadBit64(7) // downmixId
+
+	li := &LoudnessInfoSet{}
+	if r.ReadBit64(1) != 0 { // samplePeakLevelPresent
+		li.BsSamplePeakLevel = uint16(r.ReadBit64(12))
+	}
+	if r.ReadBit64(1) != 0 { // truePeakLevelPresent
+		_ = r.ReadBit64(12) // bsTruePeakLevel
+		_ = r.ReadBit64(4)  // measurementSystemForTP
+		_ = r.ReadBit64(2)  // reliabilityForTP
+	}
+	if measurementCount := r.ReadBit64(4); measurementCount > 0 {
+		_ = r.ReadBit64(4) // methodDefinition
+		li.MethodValue = uint8(r.ReadBit64(8))
+		li.MeasurementSystem = uint8(r.ReadBit64(4))
+		li.Reliability = uint8(r.ReadBit64(2))
+	}
+	return li
+}
+
+// parseLoudnessInfoSet parses just enough of loudnessInfoSet() to expose
+// the first sample-peak measurement of the first loudnessInfo() entry:
+// loudnessInfoAlbum() entries are skipped, then loudnessInfoCount gates the
+// loudnessInfo() loop that each entry's own drcSetId/downmixId live inside.
+func parseLoudnessInfoSet(r *Reader) *LoudnessInfoSet {
+	albumCount := r.ReadBit64(6) // numLoudnessInfoAlbum
+	for i := uint64(0); i < albumCount; i++ {
+		parseLoudnessInfoEntry(r)
+	}
+	if r.ReadBit64(6) == 0 { // loudnessInfoCount
+		return nil
+	}
+	return parseLoudnessInfoEntry(r)
+}
+
+// parseAudioTruncation parses audioTruncationInfo().
+func parseAudioTruncation(r *Reader) *AudioTruncationInfo {
+	info := &AudioTruncationInfo{}
+	info.Active = r.ReadBit64(1) != 0
+	_ = r.ReadBit64(1) // reserved
+	info.FromBegin = r.ReadBit64(1) != 0
+	info.Samples = uint32(r.ReadBit64(13))
+	return info
+}
+
 type MpeghAudioRecord struct {
 	BaseRecord
-	curpkt        *PesPkt
-	Pkts          []*PesPkt
-	MhasPackets   []MhasPacketInfo
-	RapFrames     []int64 // Positions of RAP frames
-	RapLog        *os.File
+	curpkt            *PesPkt
+	Pkts              []*PesPkt
+	MhasPackets       []MhasPacketInfo
+	Configs           []MhasConfigEvent // decoded MPEGH3DACFG/LOUDNESS_DRC/AUDIOTRUNCATION packets
+	RapFrames         []int64           // Positions of RAP frames
+	RapLog            *os.File
 	WorkaroundPESFlag bool
 	WorkaroundPES     []byte
+
+	// Muxer, when set, receives each access unit as an mhm1 fmp4 sample and
+	// is asked to cut a fragment whenever a RAP is detected (an access unit
+	// carrying a config or sync packet, see parseMhasPackets).
+	Muxer         *fmp4.Muxer
+	mhaConfigSent bool
 }
 
 const minMpeghAudioPesHeaderLen = 19
 
+// mhaConfigurationVersion is MHADecoderConfigurationRecord.configurationVersion
+// (ISO/IEC 23008-3), which is fixed at 1.
+const mhaConfigurationVersion = 1
+
+// maybeSendMHAConfig hands the Muxer an MHAConfig the first time a
+// PACTYP_MPEGH3DACFG packet is decoded, so the fmp4 init segment can carry
+// the stream's real channel count and sample rate instead of placeholders.
+func (s *MpeghAudioRecord) maybeSendMHAConfig(cfg *Mpegh3daConfig, rawPayload []byte) {
+	if s.Muxer == nil || s.mhaConfigSent {
+		return
+	}
+	mhaC := &fmp4.MHAConfig{
+		ConfigurationVersion:           mhaConfigurationVersion,
+		Mpegh3daProfileLevelIndication: cfg.Mpegh3daProfileLevelIndication,
+		ReferenceChannelLayout:         cfg.ReferenceLayout.CICPSpeakerLayoutIdx,
+		Mpegh3daConfig:                 append([]byte{}, rawPayload...),
+	}
+	s.Muxer.SetMHAConfig(s.Pid, uint16(cfg.NumSignals3d), cfg.SamplingFrequency(), mhaC)
+	s.mhaConfigSent = true
+}
+
 func (s *MpeghAudioRecord) LogRap(i IFrameInfo) {
 	if s.RapLog == nil {
 		var pid string = strconv.Itoa(s.Pid)
@@ -114,6 +301,13 @@ func (s *MpeghAudioRecord) Process(pkt *TsPkt) {
 				s.RapFrames = append(s.RapFrames, s.curpkt.Pos)
 			}
 			s.Pkts = append(s.Pkts, s.curpkt)
+
+			if s.Muxer != nil {
+				if err := s.Muxer.Flush(isRap); err != nil {
+					log.Println("fmp4 mux error:", err)
+				}
+				s.Muxer.AddSample(s.Pid, s.curpkt.Data, s.curpkt.Pts, s.curpkt.Dts)
+			}
 		}
 		s.curpkt = &PesPkt{}
 		s.curpkt.Pos = pkt.Pos
@@ -159,51 +353,60 @@ func (s *MpeghAudioRecord) Process(pkt *TsPkt) {
 func parseEscapedValue(r *Reader, nBits, mBits, kBits int) uint64 {
 	val := uint64(r.ReadBit64(nBits))
 	maxVal := uint64((1 << nBits) - 1)
-	
+
 	if val == maxVal {
 		val2 := uint64(r.ReadBit64(mBits))
 		val = val + val2
 		maxVal2 := uint64((1 << mBits) - 1)
-		
+
 		if val2 == maxVal2 {
 			val3 := uint64(r.ReadBit64(kBits))
 			val = val + val3
 		}
 	}
-	
+
 	return val
 }
 
-func (s *MpeghAudioRecord) parseMhasPackets(data []byte, pos int64, pts int64) bool {
+// MhasPacket is one packet's type and payload from an MHAS access unit, as
+// produced by ParseMhasPackets.
+type MhasPacket struct {
+	Type    int
+	Payload []byte
+}
+
+// ParseMhasPackets walks an MHAS access unit (ISO/IEC 23008-3) and returns
+// every packet's type and payload, for callers like Probe that need framing
+// without maintaining record state; see MpeghAudioRecord.parseMhasPackets
+// for the stateful version that also tracks RAPs and builds reports.
+func ParseMhasPackets(data []byte) []MhasPacket {
 	// MHAS Packet Layout (ISO/IEC 23008-3):
 	// MHASPacketType = escapedValue(3,8,8)
 	// MHASPacketLabel = escapedValue(2,8,32)
 	// MHASPacketLength = escapedValue(11,24,24)
 	// MHASPacketPayload(MHASPacketType)
-	
-	var isRap bool = false
-	var packetTypes []string
-	
+
+	var packets []MhasPacket
 	r := &Reader{Data: data}
-	
+
 	for r.Base < len(data) {
 		// Check if we have enough data for at least the minimum packet header
 		if r.Base+2 > len(data) {
 			break
 		}
-		
+
 		startPos := r.Base
 		startOff := r.Off
-		
+
 		// Parse MHASPacketType - escapedValue(3,8,8)
 		packetType := parseEscapedValue(r, 3, 8, 8)
-		
+
 		// Parse MHASPacketLabel - escapedValue(2,8,32)
 		_ = parseEscapedValue(r, 2, 8, 32) // packetLabel not currently used
-		
+
 		// Parse MHASPacketLength - escapedValue(11,24,24)
 		packetLength := parseEscapedValue(r, 11, 24, 24)
-		
+
 		// Validate packet length
 		if packetLength > uint64(len(data)-r.Base) {
 			// Invalid packet, try to resync
@@ -211,20 +414,53 @@ func (s *MpeghAudioRecord) parseMhasPackets(data []byte, pos int64, pts int64) b
 			r.Off = startOff
 			continue
 		}
-		
-		packetTypes = append(packetTypes, GetMpeghAudioPacketType(int(packetType)))
-		
+
+		if payloadBase := r.Base; int(packetLength) <= len(data)-payloadBase {
+			packets = append(packets, MhasPacket{
+				Type:    int(packetType),
+				Payload: data[payloadBase : payloadBase+int(packetLength)],
+			})
+		}
+
+		// Skip to next packet (advance by payload length)
+		r.SkipByte(int(packetLength))
+	}
+
+	return packets
+}
+
+func (s *MpeghAudioRecord) parseMhasPackets(data []byte, pos int64, pts int64) bool {
+	var isRap bool
+	var packetTypes []string
+
+	for _, pkt := range ParseMhasPackets(data) {
+		packetTypes = append(packetTypes, GetMpeghAudioPacketType(pkt.Type))
+
 		// Check for RAP indicators based on packet type:
 		// PACTYP_MPEGH3DACFG (1) - Config packet indicates RAP
 		// PACTYP_SYNC (6) - Sync packet
-		if packetType == 1 || packetType == 6 {
+		if pkt.Type == 1 || pkt.Type == 6 {
 			isRap = true
 		}
-		
-		// Skip to next packet (advance by payload length)
-		r.SkipByte(int(packetLength))
+
+		// Decode the payloads this package understands into structured
+		// config/loudness/truncation events instead of just logging the
+		// packet type.
+		switch pkt.Type {
+		case 1: // PACTYP_MPEGH3DACFG
+			cfg := ParseMpegh3daConfig(pkt.Payload)
+			s.Configs = append(s.Configs, MhasConfigEvent{Pos: pos, Pts: pts, Kind: "MPEGH3DACFG", Config: cfg})
+			s.maybeSendMHAConfig(cfg, pkt.Payload)
+		case 13: // PACTYP_LOUDNESS_DRC
+			if li := parseLoudnessInfoSet(&Reader{Data: pkt.Payload}); li != nil {
+				s.Configs = append(s.Configs, MhasConfigEvent{Pos: pos, Pts: pts, Kind: "LOUDNESS_DRC", Loudness: li})
+			}
+		case 17: // PACTYP_AUDIOTRUNCATION
+			tr := parseAudioTruncation(&Reader{Data: pkt.Payload})
+			s.Configs = append(s.Configs, MhasConfigEvent{Pos: pos, Pts: pts, Kind: "AUDIOTRUNCATION", Truncation: tr})
+		}
 	}
-	
+
 	if len(packetTypes) > 0 {
 		s.MhasPackets = append(s.MhasPackets, MhasPacketInfo{
 			Pos:         pos,
@@ -232,7 +468,7 @@ func (s *MpeghAudioRecord) parseMhasPackets(data []byte, pos int64, pts int64) b
 			PacketTypes: packetTypes,
 		})
 	}
-	
+
 	return isRap
 }
 
@@ -298,4 +534,57 @@ func (s *MpeghAudioRecord) Report(root string) {
 		}
 		w.Close()
 	}
+
+	if len(s.Configs) > 0 {
+		fname = filepath.Join(root, pid+"-mhas-config"+".csv")
+		w, err = os.Create(fname)
+		if err != nil {
+			panic(err)
+		}
+		header = "Pos, PTS, Kind, Details"
+		fmt.Fprintln(w, header)
+		for _, ev := range s.Configs {
+			cols := []string{
+				strconv.FormatInt(ev.Pos, 10),
+				strconv.FormatInt(ev.Pts, 10),
+				ev.Kind,
+				mhasConfigEventDetails(ev),
+			}
+			fmt.Fprintln(w, strings.Join(cols, ", "))
+		}
+		w.Close()
+
+		jname := filepath.Join(root, pid+"-mhas-config"+".json")
+		jf, err := os.Create(jname)
+		if err != nil {
+			panic(err)
+		}
+		enc := json.NewEncoder(jf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s.Configs); err != nil {
+			panic(err)
+		}
+		jf.Close()
+	}
+}
+
+// mhasConfigEventDetails renders the decoded fields of a single
+// MhasConfigEvent for the CSV report.
+func mhasConfigEventDetails(ev MhasConfigEvent) string {
+	switch {
+	case ev.Config != nil:
+		c := ev.Config
+		return fmt.Sprintf("profileLevel=%d usacSamplingFrequencyIndex=%d coreSbrFrameLengthIndex=%d receiverDelayCompensation=%t referenceLayout=%d numSignals3d=%d",
+			c.Mpegh3daProfileLevelIndication, c.UsacSamplingFrequencyIndex, c.CoreSbrFrameLengthIndex,
+			c.ReceiverDelayCompensation, c.ReferenceLayout.CICPSpeakerLayoutIdx, c.NumSignals3d)
+	case ev.Loudness != nil:
+		l := ev.Loudness
+		return fmt.Sprintf("methodValue=%d measurementSystem=%d reliability=%d bsSamplePeakLevel=%d",
+			l.MethodValue, l.MeasurementSystem, l.Reliability, l.BsSamplePeakLevel)
+	case ev.Truncation != nil:
+		t := ev.Truncation
+		return fmt.Sprintf("active=%t fromBegin=%t samples=%d", t.Active, t.FromBegin, t.Samples)
+	default:
+		return ""
+	}
 }
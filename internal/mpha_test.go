@@ -0,0 +1,68 @@
+package mpts
+
+import "testing"
+
+func TestParseEscapedValue(t *testing.T) {
+	cases := []struct {
+		name                string
+		data                []byte
+		nBits, mBits, kBits int
+		want                uint64
+	}{
+		{"fits in n bits", []byte{0x40}, 3, 8, 8, 2},
+		{"escapes into m bits", []byte{0xe0, 0x80}, 3, 8, 8, 11}, // n maxed (7) + m value (4)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseEscapedValue(&Reader{Data: c.data}, c.nBits, c.mBits, c.kBits)
+			if got != c.want {
+				t.Errorf("parseEscapedValue(% x, %d, %d, %d) = %d, want %d", c.data, c.nBits, c.mBits, c.kBits, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseMhasPackets(t *testing.T) {
+	// MHASPacketType=2 (PACTYP_MPEGH3DAFRAME, escapedValue(3,8,8)), MHASPacketLabel=1
+	// (escapedValue(2,8,32)), MHASPacketLength=3 (escapedValue(11,24,24)),
+	// followed by a 3-byte payload.
+	data := []byte{0x48, 0x03, 0xAA, 0xBB, 0xCC}
+	packets := ParseMhasPackets(data)
+	if len(packets) != 1 {
+		t.Fatalf("ParseMhasPackets(% x) returned %d packets, want 1", data, len(packets))
+	}
+	if packets[0].Type != 2 {
+		t.Errorf("packet Type = %d, want 2", packets[0].Type)
+	}
+	want := []byte{0xAA, 0xBB, 0xCC}
+	if len(packets[0].Payload) != len(want) {
+		t.Fatalf("packet Payload = % x, want % x", packets[0].Payload, want)
+	}
+	for i := range want {
+		if packets[0].Payload[i] != want[i] {
+			t.Fatalf("packet Payload = % x, want % x", packets[0].Payload, want)
+		}
+	}
+}
+
+func TestParseLoudnessInfoSetFirstEntry(t *testing.T) {
+	// numLoudnessInfoAlbum=0, loudnessInfoCount=1, one loudnessInfo() entry
+	// with drcSetId=0 downmixId=0 samplePeakLevelPresent=1
+	// bsSamplePeakLevel=0x7FF truePeakLevelPresent=0 measurementCount=0.
+	data := []byte{0x00, 0x10, 0x00, 0x5f, 0xfc, 0x00}
+	li := parseLoudnessInfoSet(&Reader{Data: data})
+	if li == nil {
+		t.Fatal("parseLoudnessInfoSet() = nil, want a non-nil entry")
+	}
+	if li.BsSamplePeakLevel != 0x7FF {
+		t.Errorf("BsSamplePeakLevel = 0x%x, want 0x7ff", li.BsSamplePeakLevel)
+	}
+}
+
+func TestParseLoudnessInfoSetNoEntries(t *testing.T) {
+	// numLoudnessInfoAlbum=0, loudnessInfoCount=0.
+	data := []byte{0x00, 0x00}
+	if li := parseLoudnessInfoSet(&Reader{Data: data}); li != nil {
+		t.Fatalf("parseLoudnessInfoSet() = %+v, want nil when loudnessInfoCount is 0", li)
+	}
+}
@@ -0,0 +1,331 @@
+package mpts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Opus TOC configs 0-31 (RFC 6716 Table 2), giving each config's codec mode,
+// audio bandwidth, and frame duration in units of 1/10 ms (so 2.5ms is
+// represented exactly).
+var opusConfigMode = []string{
+	"SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK", "SILK",
+	"Hybrid", "Hybrid", "Hybrid", "Hybrid",
+	"CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT", "CELT",
+}
+
+var opusConfigBandwidth = []string{
+	"NB", "NB", "NB", "NB", "MB", "MB", "MB", "MB", "WB", "WB", "WB", "WB",
+	"SWB", "SWB", "FB", "FB",
+	"NB", "NB", "NB", "NB", "WB", "WB", "WB", "WB", "SWB", "SWB", "SWB", "SWB", "FB", "FB", "FB", "FB",
+}
+
+var opusConfigFrameDurationTenthMs = []int{
+	100, 200, 400, 600, 100, 200, 400, 600, 100, 200, 400, 600,
+	100, 200, 100, 200,
+	25, 50, 100, 200, 25, 50, 100, 200, 25, 50, 100, 200, 25, 50, 100, 200,
+}
+
+// OpusToc is an Opus packet's decoded TOC byte (RFC 6716 Section 3.1).
+type OpusToc struct {
+	Config          uint8
+	Mode            string
+	Bandwidth       string
+	FrameDurationMs float64
+	Stereo          bool
+	FrameCountCode  uint8 // c: 0=one frame, 1=two equal-size frames, 2=two frames, 3=arbitrary count
+	FrameCount      int   // number of Opus frames this packet carries
+}
+
+// parseOpusToc decodes an Opus packet's TOC byte, plus the frame count byte
+// that follows it when FrameCountCode == 3 (RFC 6716 Section 3.2, code 3).
+func parseOpusToc(packet []byte) *OpusToc {
+	if len(packet) < 1 {
+		return nil
+	}
+	toc := packet[0]
+	config := toc >> 3
+	t := &OpusToc{
+		Config:          config,
+		Mode:            opusConfigMode[config],
+		Bandwidth:       opusConfigBandwidth[config],
+		FrameDurationMs: float64(opusConfigFrameDurationTenthMs[config]) / 10,
+		Stereo:          toc&0x04 != 0,
+		FrameCountCode:  toc & 0x03,
+	}
+	switch t.FrameCountCode {
+	case 0:
+		t.FrameCount = 1
+	case 1, 2:
+		t.FrameCount = 2
+	case 3:
+		if len(packet) >= 2 {
+			t.FrameCount = int(packet[1] & 0x3F)
+		}
+	}
+	return t
+}
+
+// opusControlHeaderPrefix is the 13-bit fixed sync pattern (0x7FE0, top 13
+// bits) the MPEG-TS Opus access unit control header starts with (Xiph.Org,
+// "Opus Audio Encapsulation for MPEG-TS / RTP").
+const opusControlHeaderPrefix = 0x7FE0
+
+// OpusAccessUnit is one MPEG-TS Opus access unit: the decoded control header
+// plus every self-delimited Opus packet it carries.
+type OpusAccessUnit struct {
+	StartTrimSamples uint16
+	EndTrimSamples   uint16
+	Packets          []*OpusToc
+}
+
+// parseOpusAccessUnit decodes the MPEG-TS Opus control header and the
+// au_size-prefixed chain of Opus packets that follows it.
+func parseOpusAccessUnit(data []byte) *OpusAccessUnit {
+	if len(data) < 2 {
+		return nil
+	}
+	prefixAndFlags := (uint16(data[0]) << 8) | uint16(data[1])
+	if prefixAndFlags&0xFFF8 != opusControlHeaderPrefix {
+		return nil
+	}
+	startTrimFlag := data[1]&0x04 != 0
+	endTrimFlag := data[1]&0x02 != 0
+	controlExtensionFlag := data[1]&0x01 != 0
+	pos := 2
+
+	au := &OpusAccessUnit{}
+	if startTrimFlag {
+		if pos+2 > len(data) {
+			return nil
+		}
+		au.StartTrimSamples = binary.BigEndian.Uint16(data[pos : pos+2])
+		pos += 2
+	}
+	if endTrimFlag {
+		if pos+2 > len(data) {
+			return nil
+		}
+		au.EndTrimSamples = binary.BigEndian.Uint16(data[pos : pos+2])
+		pos += 2
+	}
+	if controlExtensionFlag {
+		if pos+1 > len(data) {
+			return nil
+		}
+		extLen := int(data[pos])
+		pos++
+		if pos+extLen > len(data) {
+			return nil
+		}
+		pos += extLen // control extension content isn't needed for this summary
+	}
+
+	for pos < len(data) {
+		auSize := 0
+		for {
+			if pos >= len(data) {
+				return au
+			}
+			b := data[pos]
+			pos++
+			auSize += int(b)
+			if b < 255 {
+				break
+			}
+		}
+		if pos+auSize > len(data) {
+			break
+		}
+		if toc := parseOpusToc(data[pos : pos+auSize]); toc != nil {
+			au.Packets = append(au.Packets, toc)
+		}
+		pos += auSize
+	}
+	return au
+}
+
+// OpusAuInfo records the decoded control header and packets for one access
+// unit, for the per-PID report.
+type OpusAuInfo struct {
+	Pos int64
+	Pts int64
+	AU  *OpusAccessUnit
+}
+
+type OpusRecord struct {
+	BaseRecord
+	curpkt            *PesPkt
+	Pkts              []*PesPkt
+	AUs               []OpusAuInfo
+	WorkaroundPESFlag bool
+	WorkaroundPES     []byte
+}
+
+const minOpusPesHeaderLen = 19
+
+// Process reassembles PES access units and decodes each one as an Opus
+// MPEG-TS access unit. Opus has no non-keyframes, so every access unit is
+// logged as a RAP.
+func (s *OpusRecord) Process(pkt *TsPkt) {
+	s.LogAdaptFieldPrivData(pkt)
+	if pkt.PUSI == 1 {
+		if s.curpkt != nil {
+			au := parseOpusAccessUnit(s.curpkt.Data)
+			s.AUs = append(s.AUs, OpusAuInfo{Pos: s.curpkt.Pos, Pts: s.curpkt.Pts, AU: au})
+
+			info := IFrameInfo{}
+			info.Pos = s.curpkt.Pos
+			info.Pts = s.curpkt.Pts
+			info.Key = true
+			s.LogIFrame(info)
+
+			s.Pkts = append(s.Pkts, s.curpkt)
+		}
+		s.curpkt = &PesPkt{}
+		s.curpkt.Pos = pkt.Pos
+		s.curpkt.Pcr = s.BaseRecord.PcrTime
+
+		if len(pkt.Data) >= minOpusPesHeaderLen {
+			var startcode = []byte{0, 0, 1}
+			if 0 == bytes.Compare(startcode, pkt.Data[0:3]) {
+				hlen := s.curpkt.Read(pkt.Data)
+				pkt.Data = pkt.Data[hlen:]
+			} else {
+				log.Println("PES start code error")
+			}
+		} else {
+			log.Println("Workaround for pkt:", pkt.Pos, "size:", len(pkt.Data))
+			s.WorkaroundPESFlag = true
+			s.WorkaroundPES = nil
+		}
+	}
+
+	if s.WorkaroundPESFlag {
+		s.WorkaroundPES = append(s.WorkaroundPES, pkt.Data...)
+		pkt.Data = nil
+		if len(s.WorkaroundPES) >= minOpusPesHeaderLen {
+			var startcode = []byte{0, 0, 1}
+			if 0 == bytes.Compare(startcode, s.WorkaroundPES[0:3]) {
+				hlen := s.curpkt.Read(s.WorkaroundPES)
+				pkt.Data = s.WorkaroundPES[hlen:]
+				s.WorkaroundPESFlag = false
+			} else {
+				log.Println("PES start code error")
+			}
+		}
+	}
+
+	if s.curpkt != nil {
+		s.curpkt.Size += int64(len(pkt.Data))
+		s.curpkt.Data = append(s.curpkt.Data, pkt.Data...)
+	}
+}
+
+func (s *OpusRecord) Flush() {
+	if s.curpkt != nil {
+		au := parseOpusAccessUnit(s.curpkt.Data)
+		s.AUs = append(s.AUs, OpusAuInfo{Pos: s.curpkt.Pos, Pts: s.curpkt.Pts, AU: au})
+		s.Pkts = append(s.Pkts, s.curpkt)
+	}
+}
+
+func (s *OpusRecord) Report(root string) {
+	var fname string
+	var w *os.File
+	var err error
+	var pid string = strconv.Itoa(s.Pid)
+	var header string
+
+	fname = filepath.Join(root, pid+".csv")
+	w, err = os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	header = "Pos, Size, PCR, PTS, DTS, (DTS-PCR)"
+	fmt.Fprintln(w, header)
+	for _, p := range s.Pkts {
+		pcr := p.Pcr / 300
+		dts := p.Dts
+		if dts == 0 {
+			dts = p.Pts
+		}
+		cols := []string{
+			strconv.FormatInt(p.Pos, 10),
+			strconv.FormatInt(p.Size, 10),
+			strconv.FormatInt(pcr, 10),
+			strconv.FormatInt(p.Pts, 10),
+			strconv.FormatInt(dts, 10),
+			strconv.FormatInt(dts-pcr, 10),
+		}
+		fmt.Fprintln(w, strings.Join(cols, ", "))
+	}
+	w.Close()
+
+	fname = filepath.Join(root, pid+"-opus"+".csv")
+	w, err = os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	header = "Pos, PTS, Start trim, End trim, Packets"
+	fmt.Fprintln(w, header)
+
+	durationHistogram := make(map[float64]int)
+	var totalStartTrim, totalEndTrim int64
+	for _, auInfo := range s.AUs {
+		if auInfo.AU == nil {
+			continue
+		}
+		totalStartTrim += int64(auInfo.AU.StartTrimSamples)
+		totalEndTrim += int64(auInfo.AU.EndTrimSamples)
+
+		var packetDescs []string
+		for _, toc := range auInfo.AU.Packets {
+			durationHistogram[toc.FrameDurationMs] += toc.FrameCount
+			packetDescs = append(packetDescs, fmt.Sprintf("config=%d mode=%s bandwidth=%s frameDurationMs=%g stereo=%t c=%d frames=%d",
+				toc.Config, toc.Mode, toc.Bandwidth, toc.FrameDurationMs, toc.Stereo, toc.FrameCountCode, toc.FrameCount))
+		}
+		cols := []string{
+			strconv.FormatInt(auInfo.Pos, 10),
+			strconv.FormatInt(auInfo.Pts, 10),
+			strconv.FormatUint(uint64(auInfo.AU.StartTrimSamples), 10),
+			strconv.FormatUint(uint64(auInfo.AU.EndTrimSamples), 10),
+			strings.Join(packetDescs, " | "),
+		}
+		fmt.Fprintln(w, strings.Join(cols, ", "))
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Frame duration (ms), Frame count")
+	for _, ms := range sortedFloat64Keys(durationHistogram) {
+		fmt.Fprintln(w, strings.Join([]string{
+			strconv.FormatFloat(ms, 'g', -1, 64),
+			strconv.Itoa(durationHistogram[ms]),
+		}, ", "))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Total start-trimmed samples, Total end-trimmed samples")
+	fmt.Fprintln(w, strings.Join([]string{
+		strconv.FormatInt(totalStartTrim, 10),
+		strconv.FormatInt(totalEndTrim, 10),
+	}, ", "))
+	w.Close()
+}
+
+// sortedFloat64Keys returns a map's keys in ascending order, for
+// deterministic report output.
+func sortedFloat64Keys(m map[float64]int) []float64 {
+	keys := make([]float64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	return keys
+}
@@ -0,0 +1,89 @@
+package mpts
+
+import "testing"
+
+func TestParseOpusToc(t *testing.T) {
+	cases := []struct {
+		name           string
+		packet         []byte
+		wantMode       string
+		wantBandwidth  string
+		wantDurationMs float64
+		wantStereo     bool
+		wantFrameCount int
+	}{
+		{"config0 mono 1 frame", []byte{0x00}, "SILK", "NB", 10, false, 1},
+		{"config16 stereo 2 equal frames", []byte{16<<3 | 0x04 | 0x01}, "CELT", "NB", 2.5, true, 2},
+		{"config31 arbitrary frame count", []byte{31<<3 | 0x03, 5}, "CELT", "FB", 20, false, 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			toc := parseOpusToc(c.packet)
+			if toc == nil {
+				t.Fatal("parseOpusToc() = nil")
+			}
+			if toc.Mode != c.wantMode {
+				t.Errorf("Mode = %q, want %q", toc.Mode, c.wantMode)
+			}
+			if toc.Bandwidth != c.wantBandwidth {
+				t.Errorf("Bandwidth = %q, want %q", toc.Bandwidth, c.wantBandwidth)
+			}
+			if toc.FrameDurationMs != c.wantDurationMs {
+				t.Errorf("FrameDurationMs = %g, want %g", toc.FrameDurationMs, c.wantDurationMs)
+			}
+			if toc.Stereo != c.wantStereo {
+				t.Errorf("Stereo = %v, want %v", toc.Stereo, c.wantStereo)
+			}
+			if toc.FrameCount != c.wantFrameCount {
+				t.Errorf("FrameCount = %d, want %d", toc.FrameCount, c.wantFrameCount)
+			}
+		})
+	}
+}
+
+func TestParseOpusTocEmptyPacket(t *testing.T) {
+	if toc := parseOpusToc(nil); toc != nil {
+		t.Fatalf("parseOpusToc(nil) = %+v, want nil", toc)
+	}
+}
+
+func TestParseOpusAccessUnit(t *testing.T) {
+	// control header: sync=0x7FE0, no trims, no extension, then one
+	// self-delimited Opus packet (au_size=1, TOC config=0 mono 1 frame).
+	data := []byte{0x7F, 0xE0, 0x01, 0x00}
+	au := parseOpusAccessUnit(data)
+	if au == nil {
+		t.Fatal("parseOpusAccessUnit() = nil")
+	}
+	if len(au.Packets) != 1 {
+		t.Fatalf("Packets = %+v, want 1 entry", au.Packets)
+	}
+	if au.Packets[0].Mode != "SILK" {
+		t.Errorf("Packets[0].Mode = %q, want SILK", au.Packets[0].Mode)
+	}
+}
+
+func TestParseOpusAccessUnitWithTrims(t *testing.T) {
+	// control header with start_trim_flag and end_trim_flag set, then one
+	// 1-byte Opus packet.
+	data := []byte{0x7F, 0xE0 | 0x04 | 0x02, 0x00, 0x05, 0x00, 0x0A, 0x01, 0x00}
+	au := parseOpusAccessUnit(data)
+	if au == nil {
+		t.Fatal("parseOpusAccessUnit() = nil")
+	}
+	if au.StartTrimSamples != 5 {
+		t.Errorf("StartTrimSamples = %d, want 5", au.StartTrimSamples)
+	}
+	if au.EndTrimSamples != 10 {
+		t.Errorf("EndTrimSamples = %d, want 10", au.EndTrimSamples)
+	}
+	if len(au.Packets) != 1 {
+		t.Fatalf("Packets = %+v, want 1 entry", au.Packets)
+	}
+}
+
+func TestParseOpusAccessUnitRejectsBadSync(t *testing.T) {
+	if au := parseOpusAccessUnit([]byte{0x00, 0x00}); au != nil {
+		t.Fatalf("parseOpusAccessUnit() = %+v, want nil on bad sync pattern", au)
+	}
+}
@@ -0,0 +1,27 @@
+package mpts
+
+import "github.com/AlvinLi-harmonicinc/mpts/psi"
+
+// NewRecordForStream picks the Record implementation for a single elementary
+// stream based on its PMT stream_type, so the demux loop no longer needs a
+// hard-coded PID->codec table: it just asks for the record matching
+// whatever psi.Parser discovered.
+//
+// A nil return means the stream type isn't one this tool analyzes; callers
+// should still track the PID (e.g. for PCR) but can skip record-specific
+// processing. This includes H264, H265, and AAC: this tool has no dedicated
+// Record for them yet, so they fall through to the generic PES handling the
+// demux loop already does for untracked PIDs.
+func NewRecordForStream(stream psi.Stream) Record {
+	switch stream.StreamType {
+	case psi.StreamTypeH266:
+		return &H266Record{}
+	case psi.StreamTypeMpegh3dAudio:
+		return &MpeghAudioRecord{}
+	default:
+		if psi.IsOpusStream(stream) {
+			return &OpusRecord{}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,426 @@
+package mpts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	internal "github.com/AlvinLi-harmonicinc/mpts/internal"
+	"github.com/AlvinLi-harmonicinc/mpts/psi"
+)
+
+const tsSyncByte = 0x47
+
+// Packet sizes this probe recognizes: plain 188-byte TS packets, 192-byte
+// packets carrying a leading 4-byte timestamp, and 204-byte packets carrying
+// a trailing 16-byte Reed-Solomon FEC block.
+var candidatePacketSizes = []int{188, 192, 204}
+
+// VVCDecConfigInfo is the subset of the VVC decoder configuration a Probe
+// exposes: the resolution and profile/level decoded from the stream's SPS
+// (see ParseVvcSPS in the internal package).
+type VVCDecConfigInfo struct {
+	ProfileIdc int
+	LevelIdc   int
+	Width      int
+	Height     int
+}
+
+// MpeghConfigInfo is the subset of the MPEG-H 3D Audio configuration a
+// Probe exposes, decoded from the stream's MPEGH3DACFG payload (see
+// ParseMpegh3daConfig in the internal package).
+type MpeghConfigInfo struct {
+	ProfileLevelIndication int
+	SamplingFrequency      int
+	ChannelConfig          string
+}
+
+// Track is a single elementary stream as seen by Probe, modeled after
+// go-mp4's ProbeInfo Track type.
+type Track struct {
+	Pid       int
+	Codec     string
+	Timescale int
+	Language  string
+
+	VVC   *VVCDecConfigInfo
+	Mpegh *MpeghConfigInfo
+
+	raps []int64 // PTS of each random access point seen on this PID
+}
+
+// ProbeInfo is a single-pass structured summary of a transport stream,
+// returned instead of the CSV reports the CLI writes, so the module can be
+// used as a library for transcode gating, HLS/DASH segmenter input, or unit
+// tests.
+type ProbeInfo struct {
+	PacketSize int   // 188, 192, or 204
+	Bitrate    int64 // bits/sec, estimated from byte count and PCR span
+	Duration   int64 // 27MHz PCR ticks, last PCR minus first PCR
+	Tracks     []*Track
+}
+
+func trackByPid(tracks []*Track, pid int) *Track {
+	for _, t := range tracks {
+		if t.Pid == pid {
+			return t
+		}
+	}
+	return nil
+}
+
+// FirstIDR returns the PTS of the first random access point seen on the
+// first track that has one, or -1 if none was found.
+func (pi *ProbeInfo) FirstIDR() int64 {
+	for _, t := range pi.Tracks {
+		if len(t.raps) > 0 {
+			return t.raps[0]
+		}
+	}
+	return -1
+}
+
+// GOPDurations returns the PTS deltas between consecutive random access
+// points on the first track that has at least two, i.e. its GOP structure.
+func (pi *ProbeInfo) GOPDurations() []int64 {
+	for _, t := range pi.Tracks {
+		if len(t.raps) < 2 {
+			continue
+		}
+		durations := make([]int64, 0, len(t.raps)-1)
+		for i := 1; i < len(t.raps); i++ {
+			durations = append(durations, t.raps[i]-t.raps[i-1])
+		}
+		return durations
+	}
+	return nil
+}
+
+// RandomAccessPoints returns the PTS of every random access point seen on
+// the given PID.
+func (pi *ProbeInfo) RandomAccessPoints(pid int) []int64 {
+	if t := trackByPid(pi.Tracks, pid); t != nil {
+		return t.raps
+	}
+	return nil
+}
+
+func codecForStreamType(streamType uint8) string {
+	switch streamType {
+	case psi.StreamTypeH264:
+		return "h264"
+	case psi.StreamTypeH265:
+		return "h265"
+	case psi.StreamTypeH266:
+		return "h266"
+	case psi.StreamTypeAAC, psi.StreamTypeAACLATM:
+		return "aac"
+	case psi.StreamTypeMpegh3dAudio:
+		return "mpegh-3da"
+	case psi.StreamTypeOpusPrivate:
+		return "opus"
+	default:
+		return fmt.Sprintf("stream_type_0x%02x", streamType)
+	}
+}
+
+// cicpChannelConfig renders a MPEG-H speakerConfig3d() as a short string:
+// common CICP layouts get a name, everything else (including the flexible
+// layout, index 63) falls back to identifying the raw index/speaker count.
+func cicpChannelConfig(sc internal.SpeakerConfig3d) string {
+	switch sc.CICPSpeakerLayoutIdx {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	case 6:
+		return "5.1"
+	case 12:
+		return "7.1"
+	case 63:
+		return fmt.Sprintf("%d-channel", sc.NumSpeakers)
+	default:
+		return fmt.Sprintf("cicp_%d", sc.CICPSpeakerLayoutIdx)
+	}
+}
+
+func languageForStream(stream psi.Stream) string {
+	for _, d := range stream.Descriptors {
+		if d.Tag == psi.DescTagLanguage && len(d.Data) >= 3 {
+			return string(d.Data[:3])
+		}
+	}
+	return ""
+}
+
+// detectPacketSize peeks at the start of the stream and returns the packet
+// size whose sync bytes line up, defaulting to 188 if none do.
+func detectPacketSize(br *bufio.Reader) (int, error) {
+	peekLen := candidatePacketSizes[len(candidatePacketSizes)-1]*4 + 1
+	buf, err := br.Peek(peekLen)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	for _, size := range candidatePacketSizes {
+		if len(buf) < size*4+1 {
+			continue
+		}
+		// A 192-byte packet's sync byte follows its 4-byte timestamp.
+		syncOff := 0
+		if size == 192 {
+			syncOff = 4
+		}
+		aligned := true
+		for i := 0; i < 4; i++ {
+			if buf[i*size+syncOff] != tsSyncByte {
+				aligned = false
+				break
+			}
+		}
+		if aligned {
+			return size, nil
+		}
+	}
+	return 188, nil
+}
+
+// pesPayload strips a PES header from data and returns the payload plus the
+// decoded PTS (90kHz, 0 if absent). Mirrors the header layout the internal
+// records already parse via PesPkt.Read, kept self-contained here so Probe
+// doesn't need a BaseRecord-backed Record just to find RAPs.
+func pesPayload(data []byte) (payload []byte, pts int64) {
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil, 0
+	}
+	ptsDtsFlags := data[7] >> 6
+	headerDataLength := int(data[8])
+	if 9+headerDataLength > len(data) {
+		return nil, 0
+	}
+	if ptsDtsFlags&0x2 != 0 && headerDataLength >= 5 {
+		b := data[9:14]
+		pts = (int64(b[0]&0x0E) << 29) | (int64(b[1]) << 22) |
+			(int64(b[2]&0xFE) << 14) | (int64(b[3]) << 7) | (int64(b[4]) >> 1)
+	}
+	return data[9+headerDataLength:], pts
+}
+
+// ProbeReader performs a single pass over r and returns a structured
+// summary of its program/stream structure.
+func ProbeReader(r io.Reader) (*ProbeInfo, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	packetSize, err := detectPacketSize(br)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ProbeInfo{PacketSize: packetSize}
+	parser := psi.NewParser()
+	esPesBuf := make(map[int][]byte) // pid -> accumulated PES bytes since last PUSI
+	esCodec := make(map[int]string)  // pid -> codec, kept in sync with info.Tracks as PMTs arrive
+
+	var bytesRead int64
+	var firstPcr, lastPcr int64 = -1, -1
+
+	raw := make([]byte, packetSize)
+	// pkt is the 188-byte TS packet inside raw: after a 192-byte packet's
+	// 4-byte timestamp, ahead of a 204-byte packet's 16-byte FEC block.
+	tsStart := 0
+	if packetSize == 192 {
+		tsStart = 4
+	}
+	pkt := raw[tsStart : tsStart+188]
+	for {
+		if _, err := io.ReadFull(br, raw); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		bytesRead += int64(packetSize)
+		if pkt[0] != tsSyncByte {
+			continue
+		}
+		pid := (int(pkt[1]&0x1F) << 8) | int(pkt[2])
+		pusi := pkt[1]&0x40 != 0
+		adaptationFieldControl := (pkt[3] >> 4) & 0x3
+		pos := 4
+
+		if adaptationFieldControl == 2 || adaptationFieldControl == 3 {
+			if pos >= len(pkt) {
+				continue
+			}
+			adaptLen := int(pkt[pos])
+			pos++
+			if adaptLen > 0 && pos < len(pkt) {
+				pcrFlag := pkt[pos]&0x10 != 0
+				if pcrFlag && pos+6 <= len(pkt) {
+					pcrBytes := pkt[pos+1 : pos+7]
+					pcrBase := (int64(pcrBytes[0]) << 25) | (int64(pcrBytes[1]) << 17) |
+						(int64(pcrBytes[2]) << 9) | (int64(pcrBytes[3]) << 1) | (int64(pcrBytes[4]) >> 7)
+					pcr := pcrBase * 300
+					if firstPcr < 0 {
+						firstPcr = pcr
+					}
+					lastPcr = pcr
+				}
+			}
+			pos += adaptLen
+		}
+		if adaptationFieldControl == 2 || pos >= len(pkt) {
+			continue
+		}
+		payload := pkt[pos:]
+
+		switch {
+		case pid == psi.PatPid:
+			_ = parser.ParsePAT(payload)
+		case pid == psi.SdtPid:
+			_ = parser.ParseSDT(payload)
+		default:
+			if isPmtPid(parser, pid) {
+				_ = parser.ParsePMT(pid, payload)
+				registerTracks(info, parser, esCodec)
+			}
+		}
+
+		if codec, ok := esCodec[pid]; ok && (codec == "h266" || codec == "mpegh-3da" || codec == "opus") {
+			if pusi {
+				if buf := esPesBuf[pid]; buf != nil {
+					flushTrackPes(info, pid, buf)
+				}
+				esPesBuf[pid] = append([]byte{}, payload...)
+			} else if esPesBuf[pid] != nil {
+				esPesBuf[pid] = append(esPesBuf[pid], payload...)
+			}
+		}
+	}
+	for pid, buf := range esPesBuf {
+		if buf != nil {
+			flushTrackPes(info, pid, buf)
+		}
+	}
+	registerTracks(info, parser, esCodec) // pick up any PMT seen in the final packets
+
+	if firstPcr >= 0 && lastPcr > firstPcr {
+		info.Duration = lastPcr - firstPcr
+		durationSec := float64(info.Duration) / 27000000.0
+		if durationSec > 0 {
+			info.Bitrate = int64(float64(bytesRead*8) / durationSec)
+		}
+	}
+	return info, nil
+}
+
+// isPmtPid reports whether pid is a PMT PID the PAT has told us about.
+func isPmtPid(p *psi.Parser, pid int) bool {
+	for _, prog := range p.Programs() {
+		if prog.PmtPid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// registerTracks adds a Track (and esCodec entry) for every stream the
+// parser has discovered so far that Probe hasn't already registered.
+func registerTracks(info *ProbeInfo, p *psi.Parser, esCodec map[int]string) {
+	for _, prog := range p.Programs() {
+		for _, stream := range prog.Streams {
+			if _, ok := esCodec[stream.Pid]; ok {
+				continue
+			}
+			codec := codecForStreamType(stream.StreamType)
+			if psi.IsOpusStream(stream) {
+				codec = "opus"
+			}
+			esCodec[stream.Pid] = codec
+			info.Tracks = append(info.Tracks, &Track{
+				Pid:       stream.Pid,
+				Codec:     codec,
+				Timescale: 90000,
+				Language:  languageForStream(stream),
+			})
+		}
+	}
+}
+
+func flushTrackPes(info *ProbeInfo, pid int, pesData []byte) {
+	payload, pts := pesPayload(pesData)
+	if payload == nil {
+		return
+	}
+	track := trackByPid(info.Tracks, pid)
+	if track == nil {
+		return
+	}
+	switch track.Codec {
+	case "h266":
+		isRap := false
+		var lastPH *internal.VvcPH
+		for _, nal := range internal.ParseVvcNalUnitsDetailed(payload) {
+			switch nal.Type {
+			case "idr_w_radl", "idr_n_lp", "cra_nut":
+				isRap = true
+			case "gdr_nut":
+				// A GDR picture is only a genuine random-access point once
+				// its recovery period has fully elapsed (see
+				// internal.H266Record.Process for the same check).
+				if lastPH != nil && lastPH.GdrPicFlag && lastPH.RecoveryPocCnt == 0 {
+					isRap = true
+				}
+			case "ph_nut":
+				lastPH = internal.ParseVvcPH(nal.Payload)
+			case "sps_nut":
+				if sps := internal.ParseVvcSPS(nal.Payload); sps != nil {
+					track.VVC = &VVCDecConfigInfo{
+						ProfileIdc: int(sps.GeneralProfileIdc),
+						LevelIdc:   int(sps.GeneralLevelIdc),
+						Width:      int(sps.SpsPicWidthMaxInLumaSamples),
+						Height:     int(sps.SpsPicHeightMaxInLumaSamples),
+					}
+				}
+			}
+		}
+		if isRap {
+			track.raps = append(track.raps, pts)
+		}
+	case "mpegh-3da":
+		// MHAS config/sync packets are always RAPs; full decode lands in
+		// the psi-aware MpeghAudioRecord (see internal.MpeghAudioRecord).
+		isRap := false
+		for _, mhas := range internal.ParseMhasPackets(payload) {
+			if mhas.Type == 1 || mhas.Type == 6 { // PACTYP_MPEGH3DACFG, PACTYP_SYNC
+				isRap = true
+			}
+			if mhas.Type != 1 { // PACTYP_MPEGH3DACFG
+				continue
+			}
+			if cfg := internal.ParseMpegh3daConfig(mhas.Payload); cfg != nil {
+				track.Mpegh = &MpeghConfigInfo{
+					ProfileLevelIndication: int(cfg.Mpegh3daProfileLevelIndication),
+					SamplingFrequency:      int(cfg.SamplingFrequency()),
+					ChannelConfig:          cicpChannelConfig(cfg.ReferenceLayout),
+				}
+			}
+		}
+		if isRap {
+			track.raps = append(track.raps, pts)
+		}
+	case "opus":
+		// Opus has no non-keyframes: every access unit is a RAP; full
+		// decode lands in the psi-aware OpusRecord (see internal.OpusRecord).
+		track.raps = append(track.raps, pts)
+	}
+}
+
+// Probe opens file and performs a single pass over it.
+func Probe(file string) (*ProbeInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ProbeReader(f)
+}
@@ -0,0 +1,403 @@
+// Package psi decodes the MPEG-TS Program Specific Information tables (PAT,
+// PMT, SDT) needed to build a high-level view of a transport stream's
+// program structure: which programs exist, which PIDs carry their elementary
+// streams, and what codec each stream claims to be.
+package psi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Well-known PIDs carrying PSI tables (ISO/IEC 13818-1 / ETSI EN 300 468).
+const (
+	PatPid = 0x0000
+	SdtPid = 0x0011
+)
+
+// Table IDs for the sections this package understands.
+const (
+	TableIdPat = 0x00
+	TableIdPmt = 0x02
+	TableIdSdt = 0x42
+)
+
+// Descriptor tags this package recognizes. Tags it doesn't recognize are
+// still captured (see Descriptor.Name), just without a friendly name.
+const (
+	DescTagRegistration uint8 = 0x05
+	DescTagCA           uint8 = 0x09
+	DescTagLanguage     uint8 = 0x0A
+	DescTagExtension    uint8 = 0x7F // carries MPEGH_3dAudio_descriptor / VVC_video_descriptor via the extension byte
+)
+
+// Extension tags carried inside a DescTagExtension descriptor.
+const (
+	DescExtMpegh3dAudio uint8 = 0x15
+	DescExtVvcVideo     uint8 = 0x30
+)
+
+// Elementary stream types this package cares about when auto-wiring records.
+const (
+	StreamTypeH264         uint8 = 0x1B
+	StreamTypeH265         uint8 = 0x24
+	StreamTypeH266         uint8 = 0x33 // VVC
+	StreamTypeAAC          uint8 = 0x0F
+	StreamTypeAACLATM      uint8 = 0x11
+	StreamTypeMpegh3dAudio uint8 = 0x2C
+	// StreamTypeOpus is the registered MPEG-TS stream_type for Opus audio
+	// (the PMT also needs a registration_descriptor carrying the "Opus"
+	// format_identifier; see IsOpusStream). Some existing deployments
+	// instead signal Opus with the private stream_type 0x83.
+	StreamTypeOpus        uint8 = 0x06
+	StreamTypeOpusPrivate uint8 = 0x83
+)
+
+// opusFormatIdentifier is the registration_descriptor format_identifier
+// ("Opus") that, combined with StreamTypeOpus, signals an Opus audio stream
+// (see "Opus Audio Encapsulation for MPEG-TS / RTP", Xiph.Org).
+var opusFormatIdentifier = []byte("Opus")
+
+// IsOpusStream reports whether stream carries Opus audio, either via the
+// private stream_type 0x83 or via stream_type 0x06 plus a registration
+// descriptor whose format_identifier is "Opus".
+func IsOpusStream(stream Stream) bool {
+	if stream.StreamType == StreamTypeOpusPrivate {
+		return true
+	}
+	if stream.StreamType != StreamTypeOpus {
+		return false
+	}
+	for _, d := range stream.Descriptors {
+		if d.Tag == DescTagRegistration && bytes.Equal(d.Data, opusFormatIdentifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// Descriptor is a single descriptor as found in a PMT stream loop or program
+// loop, kept mostly raw since most consumers only care about the tag.
+type Descriptor struct {
+	Tag    uint8
+	ExtTag uint8 // only meaningful when Tag == DescTagExtension
+	Data   []byte
+}
+
+// Name returns a human-readable descriptor name for reporting.
+func (d Descriptor) Name() string {
+	switch d.Tag {
+	case DescTagRegistration:
+		return "registration_descriptor"
+	case DescTagCA:
+		return "CA_descriptor"
+	case DescTagLanguage:
+		return "ISO_639_language_descriptor"
+	case DescTagExtension:
+		switch d.ExtTag {
+		case DescExtMpegh3dAudio:
+			return "MPEGH_3dAudio_descriptor"
+		case DescExtVvcVideo:
+			return "VVC_video_descriptor"
+		default:
+			return fmt.Sprintf("extension_descriptor_0x%02x", d.ExtTag)
+		}
+	default:
+		return fmt.Sprintf("descriptor_0x%02x", d.Tag)
+	}
+}
+
+// Stream is a single elementary stream signaled in a PMT.
+type Stream struct {
+	Pid         int
+	StreamType  uint8
+	Descriptors []Descriptor
+}
+
+// Program models one program (aka "service") as described by the PAT/PMT/SDT.
+type Program struct {
+	Number      int
+	PmtPid      int
+	PcrPid      int
+	ServiceName string
+	Streams     []Stream
+}
+
+// Parser accumulates PAT/PMT/SDT sections as they're seen while demuxing,
+// resolving the Program/Stream model incrementally as PMTs for
+// dynamically-discovered PIDs arrive.
+type Parser struct {
+	programs map[int]*Program // keyed by program number
+	pmtPids  map[int]int      // PMT PID -> program number, learned from the PAT
+}
+
+// NewParser returns an empty Parser ready to consume PAT/PMT/SDT payloads.
+func NewParser() *Parser {
+	return &Parser{
+		programs: make(map[int]*Program),
+		pmtPids:  make(map[int]int),
+	}
+}
+
+// PendingPmtPids returns the PMT PIDs learned from the PAT that have not been
+// parsed into a Program yet, so callers know which PIDs to start demuxing.
+func (p *Parser) PendingPmtPids() []int {
+	var pids []int
+	for pid, num := range p.pmtPids {
+		if prog, ok := p.programs[num]; !ok || len(prog.Streams) == 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Programs returns the programs discovered so far, in program-number order.
+func (p *Parser) Programs() []*Program {
+	nums := make([]int, 0, len(p.programs))
+	for num := range p.programs {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	progs := make([]*Program, 0, len(nums))
+	for _, num := range nums {
+		progs = append(progs, p.programs[num])
+	}
+	return progs
+}
+
+// section strips the pointer_field (present on the first TS packet of a
+// PUSI-starting payload) and returns the table_id plus the section body that
+// follows the 3-byte table_id/section_length header, without the 4-byte
+// CRC32 trailer.
+func section(payload []byte) (tableId uint8, body []byte, ok bool) {
+	if len(payload) < 1 {
+		return 0, nil, false
+	}
+	pointerField := int(payload[0])
+	payload = payload[1:]
+	if pointerField > 0 {
+		if pointerField >= len(payload) {
+			return 0, nil, false
+		}
+		payload = payload[pointerField:]
+	}
+	if len(payload) < 3 {
+		return 0, nil, false
+	}
+	tableId = payload[0]
+	sectionLength := int(binary.BigEndian.Uint16(payload[1:3]) & 0x0FFF)
+	if sectionLength < 4 || 3+sectionLength > len(payload) {
+		return 0, nil, false
+	}
+	// Section body excludes the CRC32 trailer.
+	return tableId, payload[3 : 3+sectionLength-4], true
+}
+
+// parseDescriptors parses a descriptor loop spanning all of data.
+func parseDescriptors(data []byte) []Descriptor {
+	var descs []Descriptor
+	pos := 0
+	for pos+2 <= len(data) {
+		tag := data[pos]
+		length := int(data[pos+1])
+		pos += 2
+		if pos+length > len(data) {
+			break
+		}
+		raw := data[pos : pos+length]
+		pos += length
+		d := Descriptor{Tag: tag, Data: raw}
+		if tag == DescTagExtension && length >= 1 {
+			d.ExtTag = raw[0]
+			d.Data = raw[1:]
+		}
+		descs = append(descs, d)
+	}
+	return descs
+}
+
+// ParsePAT parses a Program Association Table payload (the TS packet's
+// payload for PID 0, pointer_field included) and records each program's PMT
+// PID so it can be picked up by PendingPmtPids.
+func (p *Parser) ParsePAT(payload []byte) error {
+	tableId, body, ok := section(payload)
+	if !ok {
+		return fmt.Errorf("psi: malformed PAT section")
+	}
+	if tableId != TableIdPat {
+		return fmt.Errorf("psi: unexpected table_id 0x%02x in PAT", tableId)
+	}
+	// Skip transport_stream_id(16) reserved(2) version_number(5) current_next_indicator(1)
+	// section_number(8) last_section_number(8); section() has already stripped
+	// table_id and section_length.
+	if len(body) < 5 {
+		return fmt.Errorf("psi: truncated PAT section")
+	}
+	body = body[5:]
+	for pos := 0; pos+4 <= len(body); pos += 4 {
+		programNumber := int(binary.BigEndian.Uint16(body[pos : pos+2]))
+		pid := int(binary.BigEndian.Uint16(body[pos+2:pos+4]) & 0x1FFF)
+		if programNumber == 0 {
+			// network_pid entry, not a program.
+			continue
+		}
+		p.pmtPids[pid] = programNumber
+		if _, ok := p.programs[programNumber]; !ok {
+			p.programs[programNumber] = &Program{Number: programNumber, PmtPid: pid}
+		} else {
+			p.programs[programNumber].PmtPid = pid
+		}
+	}
+	return nil
+}
+
+// ParsePMT parses a Program Map Table payload carried on pid, populating the
+// matching Program's PcrPid and Streams.
+func (p *Parser) ParsePMT(pid int, payload []byte) error {
+	tableId, body, ok := section(payload)
+	if !ok {
+		return fmt.Errorf("psi: malformed PMT section on pid %d", pid)
+	}
+	if tableId != TableIdPmt {
+		return fmt.Errorf("psi: unexpected table_id 0x%02x in PMT on pid %d", tableId, pid)
+	}
+	if len(body) < 9 {
+		return fmt.Errorf("psi: truncated PMT section on pid %d", pid)
+	}
+	programNumber := int(binary.BigEndian.Uint16(body[0:2]))
+	// reserved(2) version_number(5) current_next_indicator(1) section_number(8) last_section_number(8)
+	pcrPid := int(binary.BigEndian.Uint16(body[5:7]) & 0x1FFF)
+	programInfoLength := int(binary.BigEndian.Uint16(body[7:9]) & 0x0FFF)
+	pos := 9 + programInfoLength
+	if pos > len(body) {
+		return fmt.Errorf("psi: truncated PMT section on pid %d", pid)
+	}
+
+	prog, ok := p.programs[programNumber]
+	if !ok {
+		prog = &Program{Number: programNumber, PmtPid: pid}
+		p.programs[programNumber] = prog
+	}
+	prog.PcrPid = pcrPid
+	prog.Streams = nil
+
+	for pos+5 <= len(body) {
+		streamType := body[pos]
+		streamPid := int(binary.BigEndian.Uint16(body[pos+1:pos+3]) & 0x1FFF)
+		esInfoLength := int(binary.BigEndian.Uint16(body[pos+3:pos+5]) & 0x0FFF)
+		pos += 5
+		if pos+esInfoLength > len(body) {
+			break
+		}
+		stream := Stream{
+			Pid:         streamPid,
+			StreamType:  streamType,
+			Descriptors: parseDescriptors(body[pos : pos+esInfoLength]),
+		}
+		prog.Streams = append(prog.Streams, stream)
+		pos += esInfoLength
+	}
+	return nil
+}
+
+// ParseSDT parses a Service Description Table payload (PID 0x11) and fills
+// in the service (program) names already known from the PAT/PMT.
+func (p *Parser) ParseSDT(payload []byte) error {
+	tableId, body, ok := section(payload)
+	if !ok {
+		return fmt.Errorf("psi: malformed SDT section")
+	}
+	if tableId != TableIdSdt {
+		return fmt.Errorf("psi: unexpected table_id 0x%02x in SDT", tableId)
+	}
+	// transport_stream_id(16) reserved(2) version_number(5) current_next_indicator(1)
+	// section_number(8) last_section_number(8) original_network_id(16) reserved_future_use(8)
+	pos := 8
+	for pos+5 <= len(body) {
+		serviceId := int(binary.BigEndian.Uint16(body[pos : pos+2]))
+		descriptorsLoopLength := int(binary.BigEndian.Uint16(body[pos+3:pos+5]) & 0x0FFF)
+		pos += 5
+		if pos+descriptorsLoopLength > len(body) {
+			break
+		}
+		name := serviceName(parseDescriptors(body[pos : pos+descriptorsLoopLength]))
+		if prog, ok := p.programs[serviceId]; ok && name != "" {
+			prog.ServiceName = name
+		}
+		pos += descriptorsLoopLength
+	}
+	return nil
+}
+
+// service_descriptor tag (not in the const block above since it's SDT-only).
+const descTagService uint8 = 0x48
+
+// serviceName extracts the service_name from a service_descriptor, if present.
+func serviceName(descs []Descriptor) string {
+	for _, d := range descs {
+		if d.Tag != descTagService || len(d.Data) < 2 {
+			continue
+		}
+		data := d.Data[1:] // skip service_type
+		providerLen := int(data[0])
+		data = data[1+providerLen:]
+		if len(data) < 1 {
+			continue
+		}
+		nameLen := int(data[0])
+		data = data[1:]
+		if nameLen > len(data) {
+			continue
+		}
+		return string(data[:nameLen])
+	}
+	return ""
+}
+
+// Report writes <root>/psi.csv and <root>/psi.json summarizing every
+// discovered program, its streams, and the descriptor tags seen on each.
+func (p *Parser) Report(root string) {
+	fname := filepath.Join(root, "psi.csv")
+	w, err := os.Create(fname)
+	if err != nil {
+		panic(err)
+	}
+	defer w.Close()
+
+	fmt.Fprintln(w, "Program, PMT PID, PCR PID, Service, Stream PID, Stream Type, Descriptors")
+	for _, prog := range p.Programs() {
+		if len(prog.Streams) == 0 {
+			fmt.Fprintf(w, "%d, %d, %d, %s, , , \n", prog.Number, prog.PmtPid, prog.PcrPid, prog.ServiceName)
+			continue
+		}
+		for _, stream := range prog.Streams {
+			var tags string
+			for i, d := range stream.Descriptors {
+				if i > 0 {
+					tags += "; "
+				}
+				tags += d.Name()
+			}
+			fmt.Fprintf(w, "%d, %d, %d, %s, %d, 0x%02X, %s\n",
+				prog.Number, prog.PmtPid, prog.PcrPid, prog.ServiceName,
+				stream.Pid, stream.StreamType, tags)
+		}
+	}
+
+	jname := filepath.Join(root, "psi.json")
+	jf, err := os.Create(jname)
+	if err != nil {
+		panic(err)
+	}
+	defer jf.Close()
+	enc := json.NewEncoder(jf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(p.Programs()); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,118 @@
+package psi
+
+import "testing"
+
+func TestSectionRejectsMalformedInput(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"pointer field out of range", []byte{0x05, 0x00}},
+		{"too short for header", []byte{0x00, 0x00, 0x01}},
+		{"section_length shorter than CRC trailer", []byte{0x00, 0x00, 0x00, 0x02}},
+		{"section_length longer than payload", []byte{0x00, 0x00, 0x00, 0x0F, 0x00, 0x00}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, _, ok := section(c.payload); ok {
+				t.Fatalf("section(% x) succeeded, want failure", c.payload)
+			}
+		})
+	}
+}
+
+func TestSectionValid(t *testing.T) {
+	// pointer_field=0, table_id=0x00, section_length=5 (1-byte body + 4-byte CRC).
+	payload := []byte{0x00, 0x00, 0xB0, 0x05, 0xAB, 0x00, 0x00, 0x00, 0x00}
+	tableId, body, ok := section(payload)
+	if !ok {
+		t.Fatalf("section(% x) failed, want success", payload)
+	}
+	if tableId != 0x00 {
+		t.Errorf("tableId = 0x%02x, want 0x00", tableId)
+	}
+	if len(body) != 1 || body[0] != 0xAB {
+		t.Errorf("body = % x, want [ab]", body)
+	}
+}
+
+func TestParsePATRejectsTruncatedSection(t *testing.T) {
+	// pointer_field=0, table_id=TableIdPat, section_length=4: body after
+	// section() is empty, too short for the 5-byte header ParsePAT skips.
+	payload := []byte{0x00, TableIdPat, 0xB0, 0x04, 0x00, 0x00, 0x00, 0x00}
+	p := NewParser()
+	if err := p.ParsePAT(payload); err == nil {
+		t.Fatal("ParsePAT succeeded on a truncated section, want error")
+	}
+}
+
+func TestParsePMTRejectsTruncatedSection(t *testing.T) {
+	// pointer_field=0, table_id=TableIdPmt, section_length=4: body is empty,
+	// too short for the fixed 9-byte PMT header.
+	payload := []byte{0x00, TableIdPmt, 0xB0, 0x04, 0x00, 0x00, 0x00, 0x00}
+	p := NewParser()
+	if err := p.ParsePMT(0x100, payload); err == nil {
+		t.Fatal("ParsePMT succeeded on a truncated section, want error")
+	}
+}
+
+func TestParsePATThenPMT(t *testing.T) {
+	p := NewParser()
+
+	// PAT: program_number=1 -> pmt_pid=0x100.
+	patBody := []byte{
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // reserved/version/current_next
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, 0xE1, 0x00, // program_number=1, reserved|pmt_pid=0x100
+	}
+	patPayload := buildSection(TableIdPat, patBody)
+	if err := p.ParsePAT(patPayload); err != nil {
+		t.Fatalf("ParsePAT failed: %v", err)
+	}
+	pending := p.PendingPmtPids()
+	if len(pending) != 1 || pending[0] != 0x100 {
+		t.Fatalf("PendingPmtPids() = %v, want [0x100]", pending)
+	}
+
+	// PMT: program_number=1, pcr_pid=0x101, program_info_length=0, one
+	// H.266 stream on pid 0x102 with no descriptors.
+	pmtBody := []byte{
+		0x00, 0x01, // program_number
+		0xC1,       // reserved/version/current_next
+		0x00, 0x00, // section_number, last_section_number
+		0xE1, 0x01, // reserved|pcr_pid=0x101
+		0xF0, 0x00, // reserved|program_info_length=0
+		StreamTypeH266, 0xE1, 0x02, 0xF0, 0x00, // stream_type, reserved|pid, reserved|es_info_length=0
+	}
+	pmtPayload := buildSection(TableIdPmt, pmtBody)
+	if err := p.ParsePMT(0x100, pmtPayload); err != nil {
+		t.Fatalf("ParsePMT failed: %v", err)
+	}
+
+	progs := p.Programs()
+	if len(progs) != 1 {
+		t.Fatalf("Programs() returned %d programs, want 1", len(progs))
+	}
+	prog := progs[0]
+	if prog.PcrPid != 0x101 {
+		t.Errorf("PcrPid = 0x%x, want 0x101", prog.PcrPid)
+	}
+	if len(prog.Streams) != 1 || prog.Streams[0].Pid != 0x102 || prog.Streams[0].StreamType != StreamTypeH266 {
+		t.Errorf("Streams = %+v, want one H.266 stream on pid 0x102", prog.Streams)
+	}
+}
+
+// buildSection wraps body in a section header (pointer_field=0, table_id,
+// section_length covering body plus the 4-byte CRC trailer) and a
+// placeholder CRC, matching what section() expects to unwrap.
+func buildSection(tableId uint8, body []byte) []byte {
+	sectionLength := len(body) + 4
+	return append([]byte{
+		0x00, // pointer_field
+		tableId,
+		byte(0xB0 | (sectionLength>>8)&0x0F),
+		byte(sectionLength),
+	}, append(append([]byte{}, body...), 0, 0, 0, 0)...)
+}